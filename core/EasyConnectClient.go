@@ -1,18 +1,92 @@
 package core
 
 import (
+	"EasierConnect/core/config"
+	"EasierConnect/core/export"
 	"EasierConnect/core/parser"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"runtime"
+	"sync"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
 // local socks5 binding
 var SocksBind string
+
+// local http proxy binding, empty to disable
+var HttpBind string
+
+// pac server binding, empty to disable
+var PacBind string
+
+// transparent proxy binding (linux only, tcp and udp), empty to disable
+var TransparentBind string
+
+// local dns server binding, empty to disable
+var DnsBind string
+
+// public dns server used for non intranet names by the local dns server and the socks resolver,
+// empty makes the socks resolver use the system one
+var DnsUpstream = "223.5.5.5:53"
+
+// intranet names only ever go to the tunnel dns when leak protection is on, they fail instead of falling back to the public dns.
+// Names matching the server domain rules are intranet names, plus the comma separated suffixes.
+var DnsLeakProtection = true
+var IntranetSuffixes string
+
+// comma separated dns upstreams replacing the default ones (tunnel dns then DnsUpstream), and how they are queried
+var DnsResolvers string
+var DnsStrategy = StrategyFallback
+
+// max domains kept in the socks resolver cache, 0 to disable
+var DnsCacheSize = 4096
+
+// comma separated CIDRs of the clients allowed on / denied from every listener, empty allow list allows everyone
+var ClientAllow string
+var ClientDeny string
+
+// caps on the proxied connections, 0 (the default) takes the server TcpApplication maxsession / maxthread, -1 for no limit
+var MaxConns int
+var MaxConnsPerClient int
+
+// new connections per second, 0 for no limit
+var ConnRate float64
+var ConnRatePerClient float64
+
+// seconds resolving and connecting a target may take, 0 for no limit
+var DialTimeout = 10
+
+// smart routing: when the route chosen by the rules fails within the fallback timeout (seconds), the other one is tried
+// and remembered for the ttl in the learned rules file (empty to keep them in memory only)
+var SmartRouting bool
+var SmartFallbackTimeout = 3
+var LearnedRulesFile string
+var LearnedRulesTTL = 7 * 24 * time.Hour
+
+// seconds a socks5 udp destination is kept without traffic, and the max destinations of one udp association
+var UdpTimeout = 60
+var UdpMaxDestinations = 256
+
+// socks5 credentials, auth is disabled when neither user nor file is set
+var SocksUser string
+var SocksPassword string
+var SocksAuthFile string
+
+// user defined routing rules file, empty to disable, and whether it is evaluated before or after the server rules
+var LocalRulesFile string
+var LocalRulesPolicy = config.LocalRulesBefore
+
+// access log of the proxied connections (file, `-`, `syslog` or `syslog://host:port`), empty to disable
+var AccessLogFile string
+var AccessLogMaxSize int64 = 100 << 20
+var AccessLogBackups = 5
+
 var DebugDump bool
 var ParseServConfig bool
 
@@ -24,6 +98,24 @@ type EasyConnectClient struct {
 
 	endpoint *EasyConnectEndpoint
 	ipStack  *stack.Stack
+	handle   *DefaultHandle
+	rules    *config.Rules
+
+	socksAuth  *SocksAuth
+	localRules *config.LocalRules
+	clientAcl  *ClientAcl
+	connLimits *ConnLimits
+
+	learnedRules         *LearnedRules
+	smartFallbackTimeout time.Duration
+
+	resolvers   []*ResolverUpstream
+	dnsStrategy string
+
+	accessLog *AccessLog
+
+	// guards handle and the settings StartTunnel applies to it
+	tunnelLock sync.Mutex
 
 	server   string
 	username string
@@ -33,10 +125,17 @@ type EasyConnectClient struct {
 func NewEasyConnectClient(server string) *EasyConnectClient {
 	return &EasyConnectClient{
 		server: server,
+		rules:  config.NewRules(),
 	}
 }
 
-func StartClient(host string, port int, username string, password string, twfId string) {
+// Rules returns the routing rules parsed from the server for this session
+func (client *EasyConnectClient) Rules() *config.Rules {
+	return client.rules
+}
+
+// loginClient logs in interactively (asking for sms / totp codes if required), exits on failure
+func loginClient(host string, port int, username string, password string, twfId string) *EasyConnectClient {
 	server := fmt.Sprintf("%s:%d", host, port)
 
 	client := NewEasyConnectClient(server)
@@ -56,7 +155,6 @@ func StartClient(host string, port int, username string, password string, twfId
 			_, err = fmt.Scan(&smsCode)
 			if err != nil {
 				panic(err)
-				return
 			}
 
 			ip, err = client.AuthSMSCode(smsCode)
@@ -66,7 +164,6 @@ func StartClient(host string, port int, username string, password string, twfId
 			_, err = fmt.Scan(&TOTPCode)
 			if err != nil {
 				panic(err)
-				return
 			}
 
 			ip, err = client.AuthTOTP(TOTPCode)
@@ -78,11 +175,133 @@ func StartClient(host string, port int, username string, password string, twfId
 	}
 	log.Printf("Login success, your IP: %d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3])
 
+	return client
+}
+
+func StartClient(host string, port int, username string, password string, twfId string) {
+	client := loginClient(host, port, username, password, twfId)
+
+	auth, err := NewSocksAuthFrom(SocksUser, SocksPassword, SocksAuthFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	client.SetSocksAuth(auth)
+
+	acl, err := NewClientAcl(ClientAllow, ClientDeny)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	client.SetClientAcl(acl)
+
+	if LocalRulesFile != "" {
+		localRules, err := config.LoadLocalRules(LocalRulesFile, LocalRulesPolicy)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		stopWatch := make(chan struct{})
+		defer close(stopWatch)
+		go localRules.Watch(5*time.Second, stopWatch)
+
+		client.SetLocalRules(localRules)
+	}
+
+	limits := client.DefaultConnLimits()
+	if MaxConns > 0 {
+		limits.MaxConns = MaxConns
+	} else if MaxConns < 0 {
+		limits.MaxConns = 0
+	}
+	if MaxConnsPerClient > 0 {
+		limits.MaxConnsPerClient = MaxConnsPerClient
+	} else if MaxConnsPerClient < 0 {
+		limits.MaxConnsPerClient = 0
+	}
+	limits.Rate = ConnRate
+	limits.RatePerClient = ConnRatePerClient
+	client.SetConnLimits(limits)
+
+	log.Printf("Connection limits: %d in total, %d per client, %v/s in total, %v/s per client (0 for no limit)",
+		limits.MaxConns, limits.MaxConnsPerClient, limits.Rate, limits.RatePerClient)
+
+	if SmartRouting {
+		enabled, limit := client.rules.GetAutorule()
+		learned, err := LoadLearnedRules(LearnedRulesFile, LearnedRulesTTL, limit)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		stopSave := make(chan struct{})
+		defer close(stopSave)
+		go learned.SaveEvery(time.Minute, stopSave)
+
+		client.SetSmartRouting(learned, time.Duration(SmartFallbackTimeout)*time.Second)
+
+		log.Printf("Smart routing enabled, server Autorule enabled: %v, learned rules limit: %d", enabled, learned.limit)
+	}
+
+	if AccessLogFile != "" {
+		accessLog, err := OpenAccessLog(AccessLogFile, AccessLogMaxSize, AccessLogBackups)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer accessLog.Close()
+
+		client.SetAccessLog(accessLog)
+	}
+
+	// library and gui callers leave the strategy empty, that is the default fallback
+	if DnsResolvers != "" || (DnsStrategy != "" && DnsStrategy != StrategyFallback) {
+		upstreams, err := ParseResolverUpstreams(DnsResolvers)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if err = client.SetResolvers(upstreams, DnsStrategy); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	if HttpBind != "" {
+		go client.ServeHttpProxy(HttpBind, DebugDump)
+	}
+
+	if PacBind != "" {
+		go client.ServePac(PacBind, SocksBind, HttpBind)
+	}
+
+	if TransparentBind != "" {
+		go client.ServeTransparent(TransparentBind, DebugDump)
+	}
+
+	if DnsBind != "" {
+		go client.ServeDns(DnsBind, DebugDump)
+	}
+
+	// commands typed in the terminal, e.g. `connections`
+	go client.ServeConsole(os.Stdin, os.Stdout)
+
 	client.ServeSocks5(SocksBind, DebugDump)
 
 	runtime.KeepAlive(client)
 }
 
+// ExportClientRules logs in only to fetch the server rules, then writes them and the local rules as rule-provider files
+func ExportClientRules(host string, port int, username string, password string, twfId string, format string, outDir string) {
+	ParseServConfig = true
+
+	client := loginClient(host, port, username, password, twfId)
+
+	var localRules *config.LocalRules
+	if LocalRulesFile != "" {
+		var err error
+		if localRules, err = config.LoadLocalRules(LocalRulesFile, LocalRulesPolicy); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	if err := export.ExportRules(client.rules, localRules, format, outDir); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
 func (client *EasyConnectClient) Login(username string, password string) ([]byte, error) {
 	client.username = username
 	client.password = password
@@ -133,8 +352,8 @@ func (client *EasyConnectClient) LoginByTwfId(twfId string) ([]byte, error) {
 
 	// Parse Server buildconfig
 	if ParseServConfig {
-		parser.ParseResourceLists(client.server, twfId, DebugDump)
-		parser.ParseConfLists(client.server, twfId, DebugDump)
+		parser.ParseResourceLists(client.rules, client.server, twfId, DebugDump)
+		parser.ParseConfLists(client.rules, client.server, twfId, DebugDump)
 	}
 
 	client.token = (*[48]byte)([]byte(agentToken + twfId))
@@ -148,7 +367,120 @@ func (client *EasyConnectClient) LoginByTwfId(twfId string) ([]byte, error) {
 	return client.clientIp, nil
 }
 
-func (client *EasyConnectClient) ServeSocks5(socksBind string, debugDump bool) {
+// SetSocksAuth enables username/password auth on the socks5 server, nil disables it
+func (client *EasyConnectClient) SetSocksAuth(auth *SocksAuth) {
+	client.socksAuth = auth
+}
+
+// SetClientAcl restricts which client addresses may use the listeners, nil allows everyone
+func (client *EasyConnectClient) SetClientAcl(acl *ClientAcl) {
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+
+	client.clientAcl = acl
+
+	if client.handle != nil {
+		client.handle.SetClientAcl(acl)
+	}
+}
+
+// DefaultConnLimits the limits set by the server: maxsession connections in total and maxthread per client
+func (client *EasyConnectClient) DefaultConnLimits() ConnLimits {
+	return defaultConnLimits(client.rules.GetTcpApplicationLimits())
+}
+
+// SetConnLimits caps the connections of the proxy clients, the zero value disables all limits
+func (client *EasyConnectClient) SetConnLimits(limits ConnLimits) {
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+
+	client.connLimits = &limits
+
+	if client.handle != nil {
+		client.handle.conns.SetLimits(limits)
+	}
+}
+
+// SetSmartRouting enables falling back to the other route when the one of the rules fails, nil learned disables it
+func (client *EasyConnectClient) SetSmartRouting(learned *LearnedRules, fallbackTimeout time.Duration) {
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+
+	client.learnedRules = learned
+	client.smartFallbackTimeout = fallbackTimeout
+
+	if client.handle != nil {
+		client.handle.SetSmartRouting(learned, fallbackTimeout)
+	}
+}
+
+// SetLocalRules sets the user defined routing rules merged with the server rules, nil disables them
+func (client *EasyConnectClient) SetLocalRules(localRules *config.LocalRules) {
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+
+	client.localRules = localRules
+
+	if client.handle != nil {
+		client.handle.SetLocalRules(localRules)
+	}
+}
+
+// SetAccessLog sets where the closed connections are logged, nil disables the access log
+func (client *EasyConnectClient) SetAccessLog(accessLog *AccessLog) {
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+
+	client.accessLog = accessLog
+
+	if client.handle != nil {
+		client.handle.conns.SetAccessLog(accessLog)
+	}
+}
+
+// SetResolvers sets the dns upstreams and strategy (fallback or race, empty for fallback), nil upstreams restore the default ones
+func (client *EasyConnectClient) SetResolvers(upstreams []*ResolverUpstream, strategy string) error {
+	if strategy == "" {
+		strategy = StrategyFallback
+	}
+	if strategy != StrategyFallback && strategy != StrategyRace {
+		return errors.New("unknown dns strategy: " + strategy)
+	}
+
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+
+	client.resolvers = upstreams
+	client.dnsStrategy = strategy
+
+	if client.handle != nil {
+		return client.handle.SetResolvers(upstreams, strategy)
+	}
+
+	return nil
+}
+
+// tunnelHandle the handle of the started tunnel, nil before StartTunnel
+func (client *EasyConnectClient) tunnelHandle() *DefaultHandle {
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+
+	return client.handle
+}
+
+// StartTunnel sets up the netstack and starts the L3 tunnel, it must be called after login.
+func (client *EasyConnectClient) StartTunnel(debugDump bool) error {
+	if client.clientIp == nil {
+		return errors.New("not logged in")
+	}
+
+	client.tunnelLock.Lock()
+	defer client.tunnelLock.Unlock()
+
+	if client.handle != nil {
+		return nil
+	}
+
 	// Link-level endpoint used in gvisor netstack
 	client.endpoint = &EasyConnectEndpoint{}
 	client.ipStack = SetupStack(client.clientIp, client.endpoint)
@@ -157,6 +489,87 @@ func (client *EasyConnectClient) ServeSocks5(socksBind string, debugDump bool) {
 	StartProtocol(client.endpoint, client.server, client.token,
 		&[4]byte{client.clientIp[3], client.clientIp[2], client.clientIp[1], client.clientIp[0]}, debugDump)
 
+	client.handle = NewDefaultHandle(client.ipStack, client.clientIp, client.rules)
+	client.handle.SetLocalRules(client.localRules)
+	client.handle.SetClientAcl(client.clientAcl)
+	client.handle.SetSmartRouting(client.learnedRules, client.smartFallbackTimeout)
+	client.handle.conns.SetAccessLog(client.accessLog)
+	if client.connLimits != nil {
+		client.handle.conns.SetLimits(*client.connLimits)
+	}
+
+	if client.dnsStrategy != "" {
+		if err := client.handle.SetResolvers(client.resolvers, client.dnsStrategy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (client *EasyConnectClient) ServeSocks5(socksBind string, debugDump bool) {
+	if err := client.StartTunnel(debugDump); err != nil {
+		log.Fatal(err.Error())
+	}
+
 	// Socks5 server
-	ServeSocks5(client.ipStack, client.clientIp, socksBind)
+	ServeSocks5(client.handle, socksBind, client.socksAuth)
+}
+
+func (client *EasyConnectClient) ServeHttpProxy(httpBind string, debugDump bool) {
+	if err := client.StartTunnel(debugDump); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// Http proxy server
+	ServeHttpProxy(client.handle, httpBind, client.socksAuth)
+}
+
+// checkUnauthenticatedBind refuses to open a listener without authentication to other hosts while socks auth is set,
+// it would bypass it, unless -allow-clients restricts who may connect
+func (client *EasyConnectClient) checkUnauthenticatedBind(name string, bind string) error {
+	if client.socksAuth == nil || loopbackOnly(bind) || client.clientAcl.restricted() {
+		return nil
+	}
+	return errors.New(name + " has no authentication: with socks auth set, it must listen on loopback or be restricted by -allow-clients")
+}
+
+func (client *EasyConnectClient) ServeTransparent(transparentBind string, debugDump bool) {
+	if err := client.checkUnauthenticatedBind("transparent proxy", transparentBind); err != nil {
+		log.Printf("Transparent proxy disabled: %s", err.Error())
+		return
+	}
+
+	if err := client.StartTunnel(debugDump); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// Transparent proxy
+	ServeTransparent(client.handle, transparentBind)
+}
+
+func (client *EasyConnectClient) ServeDns(dnsBind string, debugDump bool) {
+	if err := client.checkUnauthenticatedBind("dns server", dnsBind); err != nil {
+		log.Printf("DNS server disabled: %s", err.Error())
+		return
+	}
+
+	if err := client.StartTunnel(debugDump); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// Dns server
+	ServeDns(client.handle, dnsBind)
+}
+
+// FlushDnsCache drops the cached dns answers, e.g. after the intranet dns changed
+func (client *EasyConnectClient) FlushDnsCache() {
+	if h := client.tunnelHandle(); h != nil {
+		h.dnsCache.Flush()
+	}
+}
+
+// ServePac serves a proxy.pac built from this session's rules and the local rules, pointing at the given listeners
+func (client *EasyConnectClient) ServePac(pacBind string, socksBind string, httpBind string) {
+	ServePac(client.rules, client.localRules, pacBind, socksBind, httpBind, client.clientAcl)
 }
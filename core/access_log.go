@@ -0,0 +1,158 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogRecord one line of the access log, written when a proxied connection is closed
+type AccessLogRecord struct {
+	Time        time.Time `json:"time"`
+	Listener    string    `json:"listener"`
+	Network     string    `json:"network"`
+	Client      string    `json:"client"`
+	Target      string    `json:"target"`
+	Ip          string    `json:"ip,omitempty"`
+	Route       string    `json:"route,omitempty"`
+	Rule        string    `json:"rule,omitempty"`
+	BytesUp     uint64    `json:"bytes_up"`
+	BytesDown   uint64    `json:"bytes_down"`
+	DurationMs  int64     `json:"duration_ms"`
+	CloseReason string    `json:"close_reason"`
+}
+
+// AccessLog writes the records as JSON Lines
+type AccessLog struct {
+	lock sync.Mutex
+	w    io.WriteCloser
+}
+
+// OpenAccessLog opens the access log: `-` for stdout, `syslog` for the local syslog,
+// `syslog://host:514` for a remote one over udp, otherwise a file rotated every maxSize bytes keeping backups old files.
+func OpenAccessLog(target string, maxSize int64, backups int) (*AccessLog, error) {
+	var w io.WriteCloser
+	var err error
+
+	switch {
+	case target == "-":
+		w = os.Stdout
+	case target == "syslog":
+		w, err = openSyslog("", "")
+	case strings.HasPrefix(target, "syslog://"):
+		w, err = openSyslog("udp", strings.TrimPrefix(target, "syslog://"))
+	default:
+		w, err = openRotatingFile(target, maxSize, backups)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessLog{w: w}, nil
+}
+
+// Log writes a record, a is nil when the access log is disabled
+func (a *AccessLog) Log(record *AccessLogRecord) {
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	_, _ = a.w.Write(line)
+}
+
+func (a *AccessLog) Close() error {
+	if a == nil || a.w == os.Stdout {
+		return nil
+	}
+
+	return a.w.Close()
+}
+
+// rotatingFile renames path to path.1 (path.1 to path.2 and so on) once it grows over maxSize
+type rotatingFile struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.backups <= 0 {
+		_ = os.Remove(f.path)
+	} else {
+		for i := f.backups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		_ = os.Rename(f.path, f.path+".1")
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.file.Close()
+}
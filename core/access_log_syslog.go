@@ -0,0 +1,12 @@
+//go:build !windows
+
+package core
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func openSyslog(network, addr string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "easierconnect")
+}
@@ -0,0 +1,10 @@
+package core
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(network, addr string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"EasierConnect/core/config"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// how long a BIND waits for the intranet host to connect back
+const bindTimeout = 2 * time.Minute
+
+var errBindTimeout = errors.New("bind: no incoming connection")
+var errBindClientClosed = errors.New("bind: client closed")
+
+// tunnelBind an ephemeral port listening on the virtual ip for the BIND command of socks4 and socks5
+type tunnelBind struct {
+	listener *gonet.TCPListener
+	tracked  *trackedConn
+	expected net.IP
+}
+
+// bindTunnel starts listening, expected is the host allowed to connect back (nil or unspecified for any host)
+func (h *DefaultHandle) bindTunnel(ctx context.Context, target string, expected net.IP) (*tunnelBind, error) {
+	listener, err := gonet.ListenTCP(h.ipStack, tcpip.FullAddress{
+		NIC:  defaultNIC,
+		Addr: tcpip.Address(h.selfIp),
+	}, header.IPv4ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &tunnelBind{listener: listener, expected: expected}
+
+	if meta, ok := ctx.Value(connMetaKey{}).(*connMeta); ok {
+		if b.tracked, err = h.conns.open(meta, "tcp", target); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		b.tracked.setRoute(expected, config.ActionVpn, "bind")
+	}
+
+	return b, nil
+}
+
+// Addr the address the client should tell the intranet host to connect to
+func (b *tunnelBind) Addr() *net.TCPAddr {
+	return b.listener.Addr().(*net.TCPAddr)
+}
+
+// Accept waits for the expected host, then stops listening. It gives up when client, the control connection, goes away.
+func (b *tunnelBind) Accept(client net.Conn) (net.Conn, error) {
+	timer := time.AfterFunc(bindTimeout, func() {
+		_ = b.listener.Close()
+	})
+	defer timer.Stop()
+	defer b.listener.Close()
+
+	ctx, stopWatch := watchClient(context.Background(), client)
+	go func() {
+		<-ctx.Done()
+		_ = b.listener.Close()
+	}()
+
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			clientGone := ctx.Err() != nil
+			stopWatch()
+
+			if !timer.Stop() {
+				err = errBindTimeout
+			} else if clientGone {
+				err = errBindClientClosed
+			}
+			b.fail(err)
+			return nil, err
+		}
+
+		peer, _ := conn.RemoteAddr().(*net.TCPAddr)
+		if b.expected == nil || b.expected.IsUnspecified() || (peer != nil && peer.IP.Equal(b.expected)) {
+			// what the client sent meanwhile belongs to the peer
+			if early := stopWatch(); len(early) > 0 {
+				if _, err = conn.Write(early); err != nil {
+					_ = conn.Close()
+					b.fail(err)
+					return nil, err
+				}
+			}
+
+			if b.tracked != nil {
+				return b.tracked.established(conn), nil
+			}
+			return conn, nil
+		}
+
+		// only the host named in the request may connect
+		_ = conn.Close()
+	}
+}
+
+// Close gives up the bind before a host connected
+func (b *tunnelBind) Close() {
+	_ = b.listener.Close()
+	b.fail(errors.New("bind: cancelled"))
+}
+
+func (b *tunnelBind) fail(err error) {
+	if b.tracked != nil {
+		b.tracked.setCloseReason(err.Error())
+		_ = b.tracked.Close()
+	}
+}
@@ -0,0 +1,18 @@
+package config
+
+import "strconv"
+
+// SetAutorule stores the Autorule settings of the server conf: whether the client gathers rules and how many it keeps
+func (r *Rules) SetAutorule(enable, ruleLimit string) {
+	r.autoruleEnabled = enable == "1"
+	r.autoruleLimit, _ = strconv.Atoi(ruleLimit)
+
+	if r.autoruleLimit < 0 {
+		r.autoruleLimit = 0
+	}
+}
+
+// GetAutorule returns whether the server enables rule gathering and its rule limit, 0 when not set
+func (r *Rules) GetAutorule() (bool, int) {
+	return r.autoruleEnabled, r.autoruleLimit
+}
@@ -1,46 +1,83 @@
 package config
 
 import (
-	"github.com/cornelk/hashmap"
 	"log"
-)
+	"path"
+	"strings"
 
-// domain[ip]
-var dnsRules *hashmap.Map[string, string]
-var dnsServers []string
+	"github.com/cornelk/hashmap"
+)
 
-func AppendSingleDnsRule(domain, ip string, debug bool) {
-	if dnsRules == nil {
-		dnsRules = hashmap.New[string, string]()
+func (r *Rules) AppendSingleDnsRule(domain, ip string, debug bool) {
+	if r.dnsRules == nil {
+		r.dnsRules = hashmap.New[string, string]()
 	}
 
 	if debug {
 		log.Printf("AppendSingleDnsRule: %s[%s]", domain, ip)
 	}
 
-	dnsRules.Set(domain, ip)
+	r.dnsRules.Set(domain, ip)
+	r.changed()
 }
 
-func GetSingleDnsRule(domain string) (string, bool) {
-	return dnsRules.Get(domain)
+func (r *Rules) GetSingleDnsRule(domain string) (string, bool) {
+	return r.dnsRules.Get(domain)
 }
 
-func IsDnsRuleAvailable() bool {
-	return dnsRules != nil
+// RangeDnsRules calls f for every dns rule until f returns false
+func (r *Rules) RangeDnsRules(f func(domain, ip string) bool) {
+	if r.IsDnsRuleAvailable() {
+		r.dnsRules.Range(f)
+	}
 }
 
-func GetDnsRuleLen() int {
-	if IsDnsRuleAvailable() {
-		return dnsRules.Len()
+func (r *Rules) IsDnsRuleAvailable() bool {
+	return r.dnsRules != nil
+}
+
+func (r *Rules) GetDnsRuleLen() int {
+	if r.IsDnsRuleAvailable() {
+		return r.dnsRules.Len()
 	} else {
 		return 0
 	}
 }
 
-func AppendDnsServer(ser ...string) {
-	dnsServers = append(dnsServers, ser...)
+func (r *Rules) AppendDnsServer(ser ...string) {
+	r.dnsServers = append(r.dnsServers, ser...)
+	r.changed()
+}
+
+func (r *Rules) GetDnsServer() []string {
+	return r.dnsServers
 }
 
-func GetDnsServer() []string {
-	return dnsServers
+func (r *Rules) AppendDnsRuleException(exceptions ...string) {
+	for _, exception := range exceptions {
+		exception = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(exception), "."))
+		if exception != "" {
+			r.dnsExceptions = append(r.dnsExceptions, exception)
+		}
+	}
+	r.changed()
+}
+
+func (r *Rules) GetDnsRuleExceptions() []string {
+	return r.dnsExceptions
+}
+
+// IsDnsRuleException reports whether domain matches an exception, `*` matches any characters including dots
+func (r *Rules) IsDnsRuleException(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	for _, exception := range r.dnsExceptions {
+		if matched, err := path.Match(exception, domain); err == nil && matched {
+			return true
+		} else if err != nil && exception == domain {
+			return true
+		}
+	}
+
+	return false
 }
@@ -1,37 +1,51 @@
 package config
 
 import (
-	"github.com/cornelk/hashmap"
 	"log"
 )
 
-// domain[[]int {min, max}]
-var domainRules *hashmap.Map[string, []int]
-
-func AppendSingleDomainRule(domain string, ports []int, debug bool) {
-	if domainRules == nil {
-		domainRules = hashmap.New[string, []int]()
-	}
-
+func (r *Rules) AppendSingleDomainRule(domain string, ports []int, debug bool) {
 	if debug {
 		log.Printf("AppendSingleDomainRule: %s[%v]", domain, ports)
 	}
 
-	domainRules.Set(domain, ports)
-}
+	r.domainLock.Lock()
+	if r.domainRules == nil {
+		r.domainRules = map[string][]int{}
+	}
+	r.domainRules[domain] = ports
+	r.domainLock.Unlock()
 
-func GetSingleDomainRule(domain string) ([]int, bool) {
-	return domainRules.Get(domain)
+	r.routesChanged()
 }
 
-func IsDomainRuleAvailable() bool {
-	return domainRules != nil
+func (r *Rules) GetSingleDomainRule(domain string) ([]int, bool) {
+	r.domainLock.RLock()
+	defer r.domainLock.RUnlock()
+
+	ports, ok := r.domainRules[domain]
+	return ports, ok
 }
 
-func GetDomainRuleLen() int {
-	if IsDomainRuleAvailable() {
-		return domainRules.Len()
-	} else {
-		return 0
+// RangeDomainRules calls f for every domain rule until f returns false, f must not add rules
+func (r *Rules) RangeDomainRules(f func(domain string, ports []int) bool) {
+	r.domainLock.RLock()
+	defer r.domainLock.RUnlock()
+
+	for domain, ports := range r.domainRules {
+		if !f(domain, ports) {
+			return
+		}
 	}
 }
+
+func (r *Rules) IsDomainRuleAvailable() bool {
+	return r.GetDomainRuleLen() > 0
+}
+
+func (r *Rules) GetDomainRuleLen() int {
+	r.domainLock.RLock()
+	defer r.domainLock.RUnlock()
+
+	return len(r.domainRules)
+}
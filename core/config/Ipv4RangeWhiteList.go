@@ -1,41 +1,143 @@
 package config
 
 import (
+	"encoding/binary"
+	"errors"
 	"log"
+	"math/bits"
+	"net"
+	"strings"
 )
 
-var Ipv4RangeRules *[]Ipv4RangeRule
-
 // Ipv4RangeRule Ipv4 rule with range
 type Ipv4RangeRule struct {
 	Rule  string
 	Ports []int
 	CIDR  bool
+
+	// inclusive numeric interval covered by the rule
+	From uint32
+	To   uint32
+}
+
+func ipv4ToUint32(ip string) (uint32, error) {
+	parsed := net.ParseIP(strings.TrimSpace(ip)).To4()
+	if parsed == nil {
+		return 0, errors.New("invalid ipv4 address: " + ip)
+	}
+
+	return binary.BigEndian.Uint32(parsed), nil
+}
+
+// ParseIpv4Range parses a `from~to` range into an inclusive numeric interval
+func ParseIpv4Range(rule string) (uint32, uint32, error) {
+	from, to, ok := strings.Cut(rule, "~")
+	if !ok {
+		return 0, 0, errors.New("invalid ipv4 range: " + rule)
+	}
+
+	fromInt, err := ipv4ToUint32(from)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	toInt, err := ipv4ToUint32(to)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if fromInt > toInt {
+		return 0, 0, errors.New("invalid ipv4 range, start after end: " + rule)
+	}
+
+	return fromInt, toInt, nil
+}
+
+// ParseIpv4CIDR parses a cidr into an inclusive numeric interval
+func ParseIpv4CIDR(rule string) (uint32, uint32, error) {
+	_, cidr, err := net.ParseCIDR(strings.TrimSpace(rule))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if cidr.IP.To4() == nil {
+		return 0, 0, errors.New("not an ipv4 cidr: " + rule)
+	}
+
+	start := binary.BigEndian.Uint32(cidr.IP.To4())
+	ones, size := cidr.Mask.Size()
+	return start, start | uint32((uint64(1)<<(size-ones))-1), nil
+}
+
+// Range returns the inclusive numeric interval covered by the rule
+func (rule Ipv4RangeRule) Range() (uint32, uint32) {
+	return rule.From, rule.To
+}
+
+// Ipv4RangeToCIDRs splits the inclusive range [from, to] into the minimal list of cidr blocks covering exactly it
+func Ipv4RangeToCIDRs(from, to uint32) []*net.IPNet {
+	var result []*net.IPNet
+
+	start := uint64(from)
+	end := uint64(to)
+	for start <= end {
+		// largest block aligned on start ...
+		hostBits := 32
+		if start != 0 {
+			hostBits = bits.TrailingZeros32(uint32(start))
+		}
+		// ... which does not go past end
+		for hostBits > 0 && start+(uint64(1)<<hostBits)-1 > end {
+			hostBits--
+		}
+
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(start))
+		result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(32-hostBits, 32)})
+
+		start += uint64(1) << hostBits
+	}
+
+	return result
 }
 
-func AppendSingleIpv4RangeRule(rule string, ports []int, cidr bool, debug bool) {
-	if Ipv4RangeRules == nil {
-		Ipv4RangeRules = &[]Ipv4RangeRule{}
+func (r *Rules) AppendSingleIpv4RangeRule(rule string, ports []int, cidr bool, debug bool) {
+	var from, to uint32
+	var err error
+	if cidr {
+		from, to, err = ParseIpv4CIDR(rule)
+	} else {
+		from, to, err = ParseIpv4Range(rule)
+	}
+
+	if err != nil {
+		log.Printf("Ignoring Ipv4 rule %s: %s", rule, err.Error())
+		return
+	}
+
+	if r.ipv4RangeRules == nil {
+		r.ipv4RangeRules = &[]Ipv4RangeRule{}
 	}
 
 	if debug {
 		log.Printf("AppendSingleIpv4RangeRule: %s%v cidr: %v", rule, ports, cidr)
 	}
 
-	*Ipv4RangeRules = append(*Ipv4RangeRules, Ipv4RangeRule{Rule: rule, Ports: ports, CIDR: cidr})
+	*r.ipv4RangeRules = append(*r.ipv4RangeRules, Ipv4RangeRule{Rule: rule, Ports: ports, CIDR: cidr, From: from, To: to})
+	r.routesChanged()
 }
 
-func GetIpv4Rules() *[]Ipv4RangeRule {
-	return Ipv4RangeRules
+func (r *Rules) GetIpv4Rules() *[]Ipv4RangeRule {
+	return r.ipv4RangeRules
 }
 
-func IsIpv4RuleAvailable() bool {
-	return Ipv4RangeRules != nil
+func (r *Rules) IsIpv4RuleAvailable() bool {
+	return r.ipv4RangeRules != nil
 }
 
-func GetIpv4RuleLen() int {
-	if IsDomainRuleAvailable() {
-		return len(*Ipv4RangeRules)
+func (r *Rules) GetIpv4RuleLen() int {
+	if r.IsIpv4RuleAvailable() {
+		return len(*r.ipv4RangeRules)
 	} else {
 		return 0
 	}
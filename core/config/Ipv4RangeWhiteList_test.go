@@ -0,0 +1,76 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIpv4RangeToCIDRs(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []string
+	}{
+		{"full range", "0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"single address", "10.1.2.3", "10.1.2.3", []string{"10.1.2.3/32"}},
+		{"lowest address", "0.0.0.0", "0.0.0.0", []string{"0.0.0.0/32"}},
+		{"highest address", "255.255.255.255", "255.255.255.255", []string{"255.255.255.255/32"}},
+		{"from the lowest address", "0.0.0.0", "0.0.0.4", []string{"0.0.0.0/30", "0.0.0.4/32"}},
+		{"to the highest address", "255.255.255.254", "255.255.255.255", []string{"255.255.255.254/31"}},
+		{"upper half", "128.0.0.0", "255.255.255.255", []string{"128.0.0.0/1"}},
+		{"aligned block", "192.168.0.0", "192.168.255.255", []string{"192.168.0.0/16"}},
+		{"unaligned start", "10.0.0.1", "10.0.0.255", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/29", "10.0.0.16/28", "10.0.0.32/27", "10.0.0.64/26", "10.0.0.128/25"}},
+		{"unaligned end", "10.0.0.0", "10.0.0.254", []string{"10.0.0.0/25", "10.0.0.128/26", "10.0.0.192/27", "10.0.0.224/28", "10.0.0.240/29", "10.0.0.248/30", "10.0.0.252/31", "10.0.0.254/32"}},
+		{"unaligned both", "10.0.0.3", "10.0.0.12", []string{"10.0.0.3/32", "10.0.0.4/30", "10.0.0.8/30", "10.0.0.12/32"}},
+		{"across an octet", "10.0.0.255", "10.0.1.0", []string{"10.0.0.255/32", "10.0.1.0/32"}},
+		{"inverted range", "10.0.0.2", "10.0.0.1", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, err := ipv4ToUint32(tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			to, err := ipv4ToUint32(tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, cidr := range Ipv4RangeToCIDRs(from, to) {
+				got = append(got, cidr.String())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Ipv4RangeToCIDRs(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIpv4Range(t *testing.T) {
+	tests := []struct {
+		rule     string
+		from, to uint32
+		wantErr  bool
+	}{
+		{"0.0.0.0~255.255.255.255", 0, 0xffffffff, false},
+		{"10.0.0.1~10.0.0.1", 0x0a000001, 0x0a000001, false},
+		{" 10.0.0.1 ~ 10.0.0.9 ", 0x0a000001, 0x0a000009, false},
+		{"10.0.0.2~10.0.0.1", 0, 0, true},
+		{"10.0.0.1", 0, 0, true},
+		{"10.0.0.1~::1", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		from, to, err := ParseIpv4Range(tt.rule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseIpv4Range(%q) error = %v, want error %v", tt.rule, err, tt.wantErr)
+			continue
+		}
+		if from != tt.from || to != tt.to {
+			t.Errorf("ParseIpv4Range(%q) = %d, %d, want %d, %d", tt.rule, from, to, tt.from, tt.to)
+		}
+	}
+}
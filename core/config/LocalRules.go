@@ -0,0 +1,304 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RouteAction string
+
+const (
+	ActionVpn    RouteAction = "vpn"
+	ActionDirect RouteAction = "direct"
+	ActionReject RouteAction = "reject"
+)
+
+// when local rules are evaluated relative to the server rules
+const (
+	LocalRulesBefore = "before"
+	LocalRulesAfter  = "after"
+)
+
+const (
+	LocalRuleDomain       = "domain"
+	LocalRuleDomainSuffix = "domain-suffix"
+	LocalRuleKeyword      = "keyword"
+	LocalRuleCIDR         = "cidr"
+	LocalRulePort         = "port"
+)
+
+// LocalRule a user defined rule, one line of the local rules file: `type,value,action[,ports]`
+type LocalRule struct {
+	Type   string
+	Value  string
+	Action RouteAction
+	Ports  []int // {min, max}, nil for any port
+	Line   int
+
+	cidr *net.IPNet
+}
+
+func (rule *LocalRule) String() string {
+	s := fmt.Sprintf("local#%d %s,%s,%s", rule.Line, rule.Type, rule.Value, rule.Action)
+	if rule.Ports != nil {
+		s += fmt.Sprintf(",%d-%d", rule.Ports[0], rule.Ports[1])
+	}
+	return s
+}
+
+func parsePortRange(value string) ([]int, error) {
+	minValue, maxValue, ok := strings.Cut(value, "-")
+	if !ok {
+		maxValue = minValue
+	}
+
+	minPort, err := strconv.Atoi(strings.TrimSpace(minValue))
+	if err != nil {
+		return nil, err
+	}
+
+	maxPort, err := strconv.Atoi(strings.TrimSpace(maxValue))
+	if err != nil {
+		return nil, err
+	}
+
+	if minPort < 0 || maxPort > 65535 || minPort > maxPort {
+		return nil, errors.New("invalid port range: " + value)
+	}
+
+	return []int{minPort, maxPort}, nil
+}
+
+func ParseLocalRule(line string, lineNumber int) (*LocalRule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	if len(fields) < 3 || len(fields) > 4 {
+		return nil, errors.New("expected `type,value,action[,ports]`")
+	}
+
+	rule := &LocalRule{
+		Type:   strings.ToLower(fields[0]),
+		Value:  strings.ToLower(fields[1]),
+		Action: RouteAction(strings.ToLower(fields[2])),
+		Line:   lineNumber,
+	}
+
+	switch rule.Action {
+	case ActionVpn, ActionDirect, ActionReject:
+	default:
+		return nil, errors.New("unknown action: " + fields[2])
+	}
+
+	switch rule.Type {
+	case LocalRuleDomain:
+		if strings.Contains(rule.Value, "*") {
+			return nil, errors.New("wildcards are not allowed in domain rules, use domain-suffix: " + fields[1])
+		}
+	case LocalRuleKeyword:
+	case LocalRuleDomainSuffix:
+		// `*.example.com` and `.example.com` are the same as `example.com`
+		rule.Value = strings.TrimPrefix(strings.TrimPrefix(rule.Value, "*"), ".")
+		if rule.Value == "" || strings.Contains(rule.Value, "*") {
+			return nil, errors.New("invalid domain suffix: " + fields[1])
+		}
+	case LocalRuleCIDR:
+		_, cidr, err := net.ParseCIDR(rule.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.cidr = cidr
+	case LocalRulePort:
+		ports, err := parsePortRange(rule.Value)
+		if err != nil {
+			return nil, err
+		}
+		rule.Ports = ports
+	default:
+		return nil, errors.New("unknown rule type: " + fields[0])
+	}
+
+	if len(fields) == 4 {
+		ports, err := parsePortRange(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		rule.Ports = ports
+	}
+
+	return rule, nil
+}
+
+// CIDR the network of a cidr rule, nil for the other types
+func (rule *LocalRule) CIDR() *net.IPNet {
+	return rule.cidr
+}
+
+// Match reports whether the rule matches the target, ip may be nil when the host was not resolved
+func (rule *LocalRule) Match(host string, ip net.IP, port int) bool {
+	if rule.Ports != nil && (port < rule.Ports[0] || port > rule.Ports[1]) {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	switch rule.Type {
+	case LocalRuleDomain:
+		return host == rule.Value
+	case LocalRuleDomainSuffix:
+		return host == rule.Value || strings.HasSuffix(host, "."+rule.Value)
+	case LocalRuleKeyword:
+		return strings.Contains(host, rule.Value)
+	case LocalRuleCIDR:
+		if hostIp := net.ParseIP(host); hostIp != nil {
+			ip = hostIp
+		}
+		return ip != nil && rule.cidr.Contains(ip)
+	case LocalRulePort:
+		return true
+	}
+
+	return false
+}
+
+// LocalRules ordered user defined rules loaded from a file, the first matching rule wins
+type LocalRules struct {
+	lock    sync.RWMutex
+	rules   []*LocalRule
+	path    string
+	modTime time.Time
+	Policy  string
+
+	// bumped on every reload, lets consumers (e.g. the pac server) know when to regenerate
+	version uint64
+}
+
+func LoadLocalRules(path string, policy string) (*LocalRules, error) {
+	if policy != LocalRulesBefore && policy != LocalRulesAfter {
+		return nil, errors.New("unknown local rules policy: " + policy)
+	}
+
+	l := &LocalRules{path: path, Policy: policy}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Reload re-reads the rules file, the current rules are kept if it contains errors
+func (l *LocalRules) Reload() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// recorded even if the file has errors, Watch only tries again once it is modified
+	l.lock.Lock()
+	l.modTime = stat.ModTime()
+	l.lock.Unlock()
+
+	var rules []*LocalRule
+	lineNumber := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := ParseLocalRule(line, lineNumber)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", l.path, lineNumber, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	l.rules = rules
+	l.lock.Unlock()
+
+	atomic.AddUint64(&l.version, 1)
+
+	log.Printf("Loaded %v local rules from %s", len(rules), l.path)
+
+	return nil
+}
+
+// Version changes whenever the rules are reloaded
+func (l *LocalRules) Version() uint64 {
+	return atomic.LoadUint64(&l.version)
+}
+
+// Rules returns the rules in evaluation order
+func (l *LocalRules) Rules() []*LocalRule {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return append([]*LocalRule(nil), l.rules...)
+}
+
+// Watch reloads the rules whenever the file is modified, until stop is closed
+func (l *LocalRules) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		stat, err := os.Stat(l.path)
+		if err != nil {
+			continue
+		}
+
+		l.lock.RLock()
+		modified := !stat.ModTime().Equal(l.modTime)
+		l.lock.RUnlock()
+
+		if modified {
+			if err = l.Reload(); err != nil {
+				log.Printf("Cannot reload local rules: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (l *LocalRules) Match(host string, ip net.IP, port int) (*LocalRule, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	for _, rule := range l.rules {
+		if rule.Match(host, ip, port) {
+			return rule, true
+		}
+	}
+
+	return nil, false
+}
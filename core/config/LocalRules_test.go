@@ -0,0 +1,159 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLocalRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    *LocalRule
+		wantErr bool
+	}{
+		{"domain,Intra.Example.com,vpn", &LocalRule{Type: LocalRuleDomain, Value: "intra.example.com", Action: ActionVpn}, false},
+		{" domain-suffix , example.com , direct ", &LocalRule{Type: LocalRuleDomainSuffix, Value: "example.com", Action: ActionDirect}, false},
+		{"domain-suffix,.example.com,direct", &LocalRule{Type: LocalRuleDomainSuffix, Value: "example.com", Action: ActionDirect}, false},
+		{"domain-suffix,*.example.com,reject", &LocalRule{Type: LocalRuleDomainSuffix, Value: "example.com", Action: ActionReject}, false},
+		{"keyword,ads,REJECT", &LocalRule{Type: LocalRuleKeyword, Value: "ads", Action: ActionReject}, false},
+		{"cidr,10.0.0.0/8,vpn,22", &LocalRule{Type: LocalRuleCIDR, Value: "10.0.0.0/8", Action: ActionVpn, Ports: []int{22, 22}}, false},
+		{"port,8000-8999,vpn", &LocalRule{Type: LocalRulePort, Value: "8000-8999", Action: ActionVpn, Ports: []int{8000, 8999}}, false},
+		{"domain,example.com,vpn,80-443", &LocalRule{Type: LocalRuleDomain, Value: "example.com", Action: ActionVpn, Ports: []int{80, 443}}, false},
+
+		{"domain,example.com", nil, true},
+		{"domain,example.com,vpn,80,443", nil, true},
+		{"domain,example.com,proxy", nil, true},
+		{"regexp,.*,vpn", nil, true},
+		{"domain,*.example.com,vpn", nil, true},
+		{"domain-suffix,*,vpn", nil, true},
+		{"cidr,10.0.0.0,vpn", nil, true},
+		{"cidr,10.0.0.0/33,vpn", nil, true},
+		{"port,443-80,vpn", nil, true},
+		{"port,70000,vpn", nil, true},
+		{"port,http,vpn", nil, true},
+		{"domain,example.com,vpn,-1", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := ParseLocalRule(tt.line, 1)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseLocalRule(%q) = %v, want an error", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLocalRule(%q): %v", tt.line, err)
+			}
+
+			got.cidr = nil
+			tt.want.Line = 1
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLocalRule(%q) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalRuleMatch(t *testing.T) {
+	tests := []struct {
+		line string
+		host string
+		ip   string
+		port int
+		want bool
+	}{
+		{"domain,example.com,vpn", "example.com", "", 80, true},
+		{"domain,example.com,vpn", "Example.COM.", "", 80, true},
+		{"domain,example.com,vpn", "www.example.com", "", 80, false},
+		{"domain-suffix,*.example.com,vpn", "example.com", "", 80, true},
+		{"domain-suffix,*.example.com,vpn", "a.b.example.com", "", 80, true},
+		{"domain-suffix,example.com,vpn", "badexample.com", "", 80, false},
+		{"keyword,ads,reject", "cdn.ads.example.com", "", 80, true},
+		{"cidr,10.0.0.0/8,vpn", "10.1.2.3", "", 80, true},
+		{"cidr,10.0.0.0/8,vpn", "intra.example.com", "10.1.2.3", 80, true},
+		{"cidr,10.0.0.0/8,vpn", "intra.example.com", "", 80, false},
+		{"cidr,10.0.0.0/8,vpn", "11.0.0.1", "", 80, false},
+		{"port,8000-8999,vpn", "example.com", "", 8080, true},
+		{"port,8000-8999,vpn", "example.com", "", 9000, false},
+		{"domain,example.com,vpn,443", "example.com", "", 443, true},
+		{"domain,example.com,vpn,443", "example.com", "", 80, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line+" "+tt.host, func(t *testing.T) {
+			rule, err := ParseLocalRule(tt.line, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.Match(tt.host, net.ParseIP(tt.ip), tt.port); got != tt.want {
+				t.Errorf("Match(%s, %s, %d) = %v, want %v", tt.host, tt.ip, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalRulesFirstMatchWins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte("# comment\n\ndomain,ads.example.com,reject\ndomain-suffix,example.com,vpn\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := LoadLocalRules(path, LocalRulesBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule, ok := l.Match("ads.example.com", nil, 80); !ok || rule.Action != ActionReject || rule.Line != 3 {
+		t.Errorf("Match(ads.example.com) = %v, %v, want the reject rule of line 3", rule, ok)
+	}
+	if rule, ok := l.Match("www.example.com", nil, 80); !ok || rule.Action != ActionVpn {
+		t.Errorf("Match(www.example.com) = %v, %v, want the vpn rule", rule, ok)
+	}
+	if _, ok := l.Match("example.org", nil, 80); ok {
+		t.Errorf("Match(example.org) matched")
+	}
+}
+
+func TestLocalRulesReloadKeepsRulesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte("domain,example.com,vpn\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := LoadLocalRules(path, LocalRulesAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := l.Version()
+
+	if err = os.WriteFile(path, []byte("domain,example.com,proxy\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	if err = os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = l.Reload(); err == nil {
+		t.Fatal("Reload of an invalid file succeeded")
+	}
+	if len(l.Rules()) != 1 || l.Version() != version {
+		t.Errorf("the rules changed after a failed reload")
+	}
+	// Watch does not try again until the file is modified
+	if !l.modTime.Equal(modTime) {
+		t.Errorf("modTime = %v, want the one of the failed attempt %v", l.modTime, modTime)
+	}
+}
+
+func TestLoadLocalRulesPolicy(t *testing.T) {
+	if _, err := LoadLocalRules(filepath.Join(t.TempDir(), "missing.txt"), "first"); err == nil {
+		t.Error("LoadLocalRules accepted an unknown policy")
+	}
+}
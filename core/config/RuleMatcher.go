@@ -0,0 +1,368 @@
+package config
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PortSet sorted, non-overlapping inclusive port ranges
+type PortSet [][2]int
+
+func (p PortSet) Contains(port int) bool {
+	i := sort.Search(len(p), func(i int) bool { return p[i][1] >= port })
+	return i < len(p) && p[i][0] <= port
+}
+
+// Union returns a new set containing the ports of both sets
+func (p PortSet) Union(other PortSet) PortSet {
+	ranges := make([][2]int, 0, len(p)+len(other))
+	ranges = append(ranges, p...)
+	ranges = append(ranges, other...)
+	return newPortSet(ranges)
+}
+
+func newPortSet(ranges [][2]int) PortSet {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	var result PortSet
+	for _, r := range ranges {
+		if n := len(result); n > 0 && r[0] <= result[n-1][1]+1 {
+			if r[1] > result[n-1][1] {
+				result[n-1][1] = r[1]
+			}
+			continue
+		}
+		result = append(result, r)
+	}
+
+	return result
+}
+
+func portRangeOf(ports []int) [2]int {
+	if len(ports) < 2 {
+		return [2]int{1, 65535}
+	}
+	return [2]int{ports[0], ports[1]}
+}
+
+func portSetOf(ports []int) PortSet {
+	return PortSet{portRangeOf(ports)}
+}
+
+// domainNode node of a trie keyed by domain labels from right to left (com -> example -> www)
+type domainNode struct {
+	children map[string]*domainNode
+	exact    PortSet // rule for the domain itself
+	wildcard PortSet // rule for `*.domain`
+}
+
+func (n *domainNode) child(label string) *domainNode {
+	if n.children == nil {
+		n.children = map[string]*domainNode{}
+	}
+
+	c, ok := n.children[label]
+	if !ok {
+		c = &domainNode{}
+		n.children[label] = c
+	}
+	return c
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func (n *domainNode) insert(domain string, ports PortSet) {
+	domain = normalizeDomain(domain)
+
+	wildcard := strings.HasPrefix(domain, "*.")
+	if wildcard {
+		domain = domain[2:]
+	}
+
+	labels := strings.Split(domain, ".")
+	node := n
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.child(labels[i])
+	}
+
+	if wildcard {
+		node.wildcard = node.wildcard.Union(ports)
+	} else {
+		node.exact = node.exact.Union(ports)
+	}
+}
+
+// lookup returns the exact rule if any, otherwise the most specific matching wildcard rule
+func (n *domainNode) lookup(domain string) (PortSet, string, bool) {
+	domain = normalizeDomain(domain)
+
+	var matched PortSet
+	var matchedRule string
+
+	node := n
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.wildcard != nil {
+			matched = node.wildcard
+			matchedRule = "*." + strings.Join(labels[i+1:], ".")
+		}
+
+		next, ok := node.children[labels[i]]
+		if !ok {
+			return matched, matchedRule, matched != nil
+		}
+		node = next
+	}
+
+	if node.exact != nil {
+		return node.exact, domain, true
+	}
+
+	return matched, matchedRule, matched != nil
+}
+
+// ipSegment disjoint ipv4 interval with the union of the ports of every rule covering it
+type ipSegment struct {
+	start uint32
+	end   uint32
+	ports PortSet
+	rule  string // the innermost rule covering it, for logging
+}
+
+// RuleMatcher rules compiled for fast lookup: a domain trie and sorted disjoint ipv4 segments searched by bisection
+type RuleMatcher struct {
+	domains  *domainNode
+	segments []ipSegment
+	allSites PortSet // `*` rule, every site is proxied on these ports
+
+	version uint64
+}
+
+type ipInterval struct {
+	start uint32
+	end   uint32
+	ports [2]int
+	rule  string
+}
+
+// intervalHeap indexes of intervals, the innermost one (latest start, then earliest end) first
+type intervalHeap struct {
+	intervals []ipInterval
+	indexes   []int
+}
+
+func (h *intervalHeap) Len() int { return len(h.indexes) }
+
+func (h *intervalHeap) Less(i, j int) bool {
+	a, b := h.intervals[h.indexes[i]], h.intervals[h.indexes[j]]
+	if a.start != b.start {
+		return a.start > b.start
+	}
+	if a.end != b.end {
+		return a.end < b.end
+	}
+	return h.indexes[i] > h.indexes[j]
+}
+
+func (h *intervalHeap) Swap(i, j int) { h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i] }
+
+func (h *intervalHeap) Push(x any) { h.indexes = append(h.indexes, x.(int)) }
+
+func (h *intervalHeap) Pop() any {
+	n := len(h.indexes)
+	x := h.indexes[n-1]
+	h.indexes = h.indexes[:n-1]
+	return x
+}
+
+// compileSegments splits the intervals into disjoint segments, sweeping over their bounds.
+// The active intervals are kept incrementally so nested ranges do not cost a walk over all of them at every bound.
+func compileSegments(intervals []ipInterval) []ipSegment {
+	type event struct {
+		at    uint64
+		open  bool
+		index int
+	}
+
+	events := make([]event, 0, len(intervals)*2)
+	for i, interval := range intervals {
+		events = append(events, event{at: uint64(interval.start), open: true, index: i})
+		events = append(events, event{at: uint64(interval.end) + 1, open: false, index: i})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].at < events[j].at })
+
+	var segments []ipSegment
+	active := 0
+
+	// active intervals counted per port range, the union is only rebuilt when a range appears or disappears
+	activePorts := map[[2]int]int{}
+	var ports PortSet
+	portsChanged := false
+
+	// closed intervals are dropped from the heap once they reach its top
+	innermost := &intervalHeap{intervals: intervals}
+	closed := make([]bool, len(intervals))
+
+	for i := 0; i < len(events); {
+		at := events[i].at
+		for ; i < len(events) && events[i].at == at; i++ {
+			index := events[i].index
+			portRange := intervals[index].ports
+
+			if events[i].open {
+				active++
+				heap.Push(innermost, index)
+
+				activePorts[portRange]++
+				if activePorts[portRange] == 1 {
+					portsChanged = true
+				}
+			} else {
+				active--
+				closed[index] = true
+
+				activePorts[portRange]--
+				if activePorts[portRange] == 0 {
+					delete(activePorts, portRange)
+					portsChanged = true
+				}
+			}
+		}
+
+		if active == 0 || at > 0xffffffff {
+			continue
+		}
+
+		for closed[innermost.indexes[0]] {
+			heap.Pop(innermost)
+		}
+
+		if portsChanged {
+			ranges := make([][2]int, 0, len(activePorts))
+			for portRange := range activePorts {
+				ranges = append(ranges, portRange)
+			}
+			ports = newPortSet(ranges)
+			portsChanged = false
+		}
+
+		end := uint64(0xffffffff)
+		if i < len(events) {
+			end = events[i].at - 1
+		}
+
+		segments = append(segments, ipSegment{start: uint32(at), end: uint32(end), ports: ports, rule: intervals[innermost.indexes[0]].rule})
+	}
+
+	return segments
+}
+
+func (r *Rules) compileMatcher() *RuleMatcher {
+	startTime := time.Now()
+
+	m := &RuleMatcher{domains: &domainNode{}, version: atomic.LoadUint64(&r.routeVersion)}
+
+	r.RangeDomainRules(func(domain string, ports []int) bool {
+		if domain == "*" {
+			m.allSites = m.allSites.Union(portSetOf(ports))
+		} else if domain != "" && !strings.ContainsAny(domain, "/:") {
+			m.domains.insert(domain, portSetOf(ports))
+		}
+		return true
+	})
+
+	var intervals []ipInterval
+	if r.IsIpv4RuleAvailable() {
+		for _, rule := range *r.GetIpv4Rules() {
+			start, end := rule.Range()
+			intervals = append(intervals, ipInterval{start: start, end: end, ports: portRangeOf(rule.Ports), rule: rule.Rule})
+		}
+	}
+	m.segments = compileSegments(intervals)
+
+	log.Printf("Compiled rules: %v domains rules, %v ipv4 rules -> %v segments in %v", r.GetDomainRuleLen(), len(intervals), len(m.segments), time.Since(startTime))
+
+	return m
+}
+
+// Compile (re)builds the matcher, the parser does it once the rules are parsed.
+// Rules added afterwards get it rebuilt on the next lookup.
+func (r *Rules) Compile() *RuleMatcher {
+	m := r.compileMatcher()
+	r.matcher.Store(m)
+	return m
+}
+
+func (r *Rules) getMatcher() *RuleMatcher {
+	m := r.matcher.Load()
+	if m != nil && m.version == atomic.LoadUint64(&r.routeVersion) {
+		return m
+	}
+
+	r.compileLock.Lock()
+	defer r.compileLock.Unlock()
+
+	if m = r.matcher.Load(); m == nil || m.version != atomic.LoadUint64(&r.routeVersion) {
+		m = r.Compile()
+	}
+	return m
+}
+
+// Match reports whether host:port should go through the vpn according to the server rules.
+// host is either a domain or an ipv4 address, the string describes the matched rule.
+func (r *Rules) Match(host string, port int) (bool, string) {
+	m := r.getMatcher()
+
+	ports, rule, found := m.domains.lookup(host)
+
+	if !found {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			n := binary.BigEndian.Uint32(ip)
+			i := sort.Search(len(m.segments), func(i int) bool { return m.segments[i].end >= n })
+			if i < len(m.segments) && m.segments[i].start <= n {
+				ports, rule, found = m.segments[i].ports, m.segments[i].rule, true
+			}
+		}
+	}
+
+	// 泛域全网资源
+	if m.allSites != nil {
+		if !found {
+			rule = "*"
+		}
+		ports = ports.Union(m.allSites)
+		found = true
+	}
+
+	if !found {
+		return false, ""
+	}
+
+	return ports.Contains(port), fmt.Sprintf("%s%v", rule, ports)
+}
+
+// IsIntranet reports whether host is covered by any server rule, whatever the port
+func (r *Rules) IsIntranet(host string) bool {
+	m := r.getMatcher()
+
+	if _, _, found := m.domains.lookup(host); found {
+		return true
+	}
+
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		n := binary.BigEndian.Uint32(ip)
+		i := sort.Search(len(m.segments), func(i int) bool { return m.segments[i].end >= n })
+		return i < len(m.segments) && m.segments[i].start <= n
+	}
+
+	return false
+}
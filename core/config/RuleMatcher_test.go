@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMatchDomain(t *testing.T) {
+	r := NewRules()
+	r.AppendSingleDomainRule("example.com", []int{80, 80}, false)
+	r.AppendSingleDomainRule("*.example.com", []int{1, 65535}, false)
+	r.AppendSingleDomainRule("*.a.example.com", []int{443, 443}, false)
+	r.AppendSingleDomainRule("*.wild.net", []int{1, 65535}, false)
+	r.AppendSingleDomainRule("Mixed.Example.org", []int{1, 65535}, false)
+
+	tests := []struct {
+		host  string
+		port  int
+		want  bool
+		found bool
+		rule  string
+	}{
+		{"example.com", 80, true, true, "example.com[[80 80]]"},
+		{"example.com", 443, false, true, "example.com[[80 80]]"},
+		{"www.example.com", 443, true, true, "*.example.com[[1 65535]]"},
+		{"deep.www.example.com", 8080, true, true, "*.example.com[[1 65535]]"},
+		// the most specific wildcard wins, its ports are not merged with the broader one
+		{"x.a.example.com", 443, true, true, "*.a.example.com[[443 443]]"},
+		{"x.a.example.com", 80, false, true, "*.a.example.com[[443 443]]"},
+		// `*.a.example.com` does not cover its apex, `*.example.com` does
+		{"a.example.com", 80, true, true, "*.example.com[[1 65535]]"},
+		{"wild.net", 80, false, false, ""},
+		{"x.wild.net", 80, true, true, "*.wild.net[[1 65535]]"},
+		{"WWW.Example.COM.", 443, true, true, "*.example.com[[1 65535]]"},
+		{"mixed.example.org", 80, true, true, "mixed.example.org[[1 65535]]"},
+		{"example.org", 80, false, false, ""},
+		{"notexample.com", 80, false, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s:%d", tt.host, tt.port), func(t *testing.T) {
+			got, rule := r.Match(tt.host, tt.port)
+			if got != tt.want || rule != tt.rule {
+				t.Errorf("Match(%s, %d) = %v, %q, want %v, %q", tt.host, tt.port, got, rule, tt.want, tt.rule)
+			}
+			if found := r.IsIntranet(tt.host); found != tt.found {
+				t.Errorf("IsIntranet(%s) = %v, want %v", tt.host, found, tt.found)
+			}
+		})
+	}
+}
+
+func TestCompileSegments(t *testing.T) {
+	tests := []struct {
+		name      string
+		intervals []ipInterval
+		want      []ipSegment
+	}{
+		{"no interval", nil, nil},
+		{
+			"nested",
+			[]ipInterval{{0, 255, [2]int{80, 80}, "outer"}, {16, 31, [2]int{443, 443}, "inner"}},
+			[]ipSegment{
+				{0, 15, PortSet{{80, 80}}, "outer"},
+				{16, 31, PortSet{{80, 80}, {443, 443}}, "inner"},
+				{32, 255, PortSet{{80, 80}}, "outer"},
+			},
+		},
+		{
+			"overlapping",
+			[]ipInterval{{100, 200, [2]int{1, 10}, "a"}, {150, 300, [2]int{5, 20}, "b"}},
+			[]ipSegment{
+				{100, 149, PortSet{{1, 10}}, "a"},
+				{150, 200, PortSet{{1, 20}}, "b"},
+				{201, 300, PortSet{{5, 20}}, "b"},
+			},
+		},
+		{
+			"adjacent",
+			[]ipInterval{{100, 199, [2]int{80, 80}, "a"}, {200, 299, [2]int{80, 80}, "b"}},
+			[]ipSegment{
+				{100, 199, PortSet{{80, 80}}, "a"},
+				{200, 299, PortSet{{80, 80}}, "b"},
+			},
+		},
+		{
+			"disjoint",
+			[]ipInterval{{30, 40, [2]int{80, 80}, "b"}, {10, 20, [2]int{80, 80}, "a"}},
+			[]ipSegment{
+				{10, 20, PortSet{{80, 80}}, "a"},
+				{30, 40, PortSet{{80, 80}}, "b"},
+			},
+		},
+		{
+			"port union of the same range",
+			[]ipInterval{{0, 10, [2]int{80, 80}, "a"}, {0, 10, [2]int{81, 81}, "b"}, {0, 10, [2]int{443, 443}, "c"}},
+			[]ipSegment{{0, 10, PortSet{{80, 81}, {443, 443}}, "c"}},
+		},
+		{
+			"whole address space",
+			[]ipInterval{{0, 0xffffffff, [2]int{1, 65535}, "all"}, {0xffffff00, 0xffffffff, [2]int{443, 443}, "top"}},
+			[]ipSegment{
+				{0, 0xfffffeff, PortSet{{1, 65535}}, "all"},
+				{0xffffff00, 0xffffffff, PortSet{{1, 65535}}, "top"},
+			},
+		},
+		{
+			"single addresses at the bounds",
+			[]ipInterval{{0, 0, [2]int{80, 80}, "lowest"}, {0xffffffff, 0xffffffff, [2]int{80, 80}, "highest"}},
+			[]ipSegment{
+				{0, 0, PortSet{{80, 80}}, "lowest"},
+				{0xffffffff, 0xffffffff, PortSet{{80, 80}}, "highest"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compileSegments(tt.intervals); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compileSegments() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchIpv4(t *testing.T) {
+	r := NewRules()
+	r.AppendSingleIpv4RangeRule("10.0.0.0~10.0.0.255", []int{80, 80}, false, false)
+	r.AppendSingleIpv4RangeRule("10.0.0.16/28", []int{443, 443}, true, false)
+	r.AppendSingleDomainRule("intra.example.com", []int{1, 65535}, false)
+
+	tests := []struct {
+		host  string
+		port  int
+		want  bool
+		found bool
+		rule  string
+	}{
+		{"10.0.0.1", 80, true, true, "10.0.0.0~10.0.0.255[[80 80]]"},
+		{"10.0.0.1", 443, false, true, "10.0.0.0~10.0.0.255[[80 80]]"},
+		{"10.0.0.20", 443, true, true, "10.0.0.16/28[[80 80] [443 443]]"},
+		{"10.0.0.20", 80, true, true, "10.0.0.16/28[[80 80] [443 443]]"},
+		{"10.0.0.255", 80, true, true, "10.0.0.0~10.0.0.255[[80 80]]"},
+		{"10.0.1.0", 80, false, false, ""},
+		{"9.255.255.255", 80, false, false, ""},
+		{"::1", 80, false, false, ""},
+		{"intra.example.com", 22, true, true, "intra.example.com[[1 65535]]"},
+		{"public.example.com", 80, false, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s:%d", tt.host, tt.port), func(t *testing.T) {
+			got, rule := r.Match(tt.host, tt.port)
+			if got != tt.want || rule != tt.rule {
+				t.Errorf("Match(%s, %d) = %v, %q, want %v, %q", tt.host, tt.port, got, rule, tt.want, tt.rule)
+			}
+			if found := r.IsIntranet(tt.host); found != tt.found {
+				t.Errorf("IsIntranet(%s) = %v, want %v", tt.host, found, tt.found)
+			}
+		})
+	}
+}
+
+func TestMatchAllSites(t *testing.T) {
+	r := NewRules()
+	r.AppendSingleDomainRule("*", []int{80, 80}, false)
+	r.AppendSingleDomainRule("intra.example.com", []int{443, 443}, false)
+	r.AppendSingleIpv4RangeRule("10.0.0.0~10.0.0.255", []int{22, 22}, false, false)
+
+	tests := []struct {
+		host string
+		port int
+		want bool
+		rule string
+	}{
+		// the ports of `*` are added to those of the matching rule
+		{"intra.example.com", 443, true, "intra.example.com[[80 80] [443 443]]"},
+		{"intra.example.com", 80, true, "intra.example.com[[80 80] [443 443]]"},
+		{"10.0.0.1", 22, true, "10.0.0.0~10.0.0.255[[22 22] [80 80]]"},
+		{"public.example.com", 80, true, "*[[80 80]]"},
+		{"public.example.com", 443, false, "*[[80 80]]"},
+		{"8.8.8.8", 80, true, "*[[80 80]]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s:%d", tt.host, tt.port), func(t *testing.T) {
+			if got, rule := r.Match(tt.host, tt.port); got != tt.want || rule != tt.rule {
+				t.Errorf("Match(%s, %d) = %v, %q, want %v, %q", tt.host, tt.port, got, rule, tt.want, tt.rule)
+			}
+		})
+	}
+}
+
+// benchmarkRules 100k domain rules (one in ten a wildcard) and 100k ipv4 ranges, half of them nested
+func benchmarkRules() *Rules {
+	r := NewRules()
+
+	for i := 0; i < 100000; i++ {
+		domain := fmt.Sprintf("host%d.dept%d.example.edu", i, i%1000)
+		if i%10 == 0 {
+			domain = fmt.Sprintf("*.dept%d.example.edu", i%1000)
+		}
+		r.AppendSingleDomainRule(domain, []int{1, 65535}, false)
+	}
+
+	for i := 0; i < 50000; i++ {
+		// disjoint /26 ranges from 10.0.0.0
+		start := uint32(10<<24 + i*64)
+		r.AppendSingleIpv4RangeRule(fmt.Sprintf("%s~%s", uint32ToIpv4(start), uint32ToIpv4(start+63)), []int{80, 443}, false, false)
+
+		// ranges nested in each other, centered on 172.16.0.0
+		center := uint32(172<<24 | 16<<16)
+		r.AppendSingleIpv4RangeRule(fmt.Sprintf("%s~%s", uint32ToIpv4(center-uint32(i)), uint32ToIpv4(center+uint32(i))), []int{i % 1000, 65535}, false, false)
+	}
+
+	return r
+}
+
+func uint32ToIpv4(n uint32) string {
+	return fmt.Sprintf("%d.%d.%d.%d", n>>24, n>>16&0xff, n>>8&0xff, n&0xff)
+}
+
+func BenchmarkCompile(b *testing.B) {
+	r := benchmarkRules()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.Compile()
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	r := benchmarkRules()
+	r.Compile()
+
+	hosts := []string{
+		"host12345.dept345.example.edu", // exact
+		"other.dept10.example.edu",      // wildcard
+		"unknown.example.com",           // no rule
+		"10.0.100.7",                    // disjoint range
+		"172.16.0.1",                    // nested ranges
+		"8.8.8.8",                       // no rule
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.Match(hosts[i%len(hosts)], 443)
+	}
+}
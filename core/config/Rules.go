@@ -0,0 +1,58 @@
+package config
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/cornelk/hashmap"
+)
+
+// Rules holds the routing rules parsed from the server, one per session
+type Rules struct {
+	// domain[ip]
+	dnsRules   *hashmap.Map[string, string]
+	dnsServers []string
+
+	// domains never resolved by the intranet dns nor overridden by dns rules, may contain wildcards
+	dnsExceptions []string
+
+	// domain[[]int {min, max}], a plain map: the concurrent one is far too slow to fill with large rule lists
+	domainLock  sync.RWMutex
+	domainRules map[string][]int
+
+	ipv4RangeRules *[]Ipv4RangeRule
+
+	// TcpApplication limits of the server conf, 0 when not set
+	maxSession int
+	maxThread  int
+
+	// Autorule of the server conf, the limit is 0 when not set
+	autoruleEnabled bool
+	autoruleLimit   int
+
+	// bumped on every change, lets consumers (e.g. the pac server) know when to regenerate
+	version uint64
+	// bumped when a domain or ipv4 rule is added, the only rules the matcher is compiled from
+	routeVersion uint64
+
+	matcher     atomic.Pointer[RuleMatcher]
+	compileLock sync.Mutex
+}
+
+func NewRules() *Rules {
+	return &Rules{}
+}
+
+// Version changes whenever a rule is added
+func (r *Rules) Version() uint64 {
+	return atomic.LoadUint64(&r.version)
+}
+
+func (r *Rules) changed() {
+	atomic.AddUint64(&r.version, 1)
+}
+
+func (r *Rules) routesChanged() {
+	atomic.AddUint64(&r.routeVersion, 1)
+	r.changed()
+}
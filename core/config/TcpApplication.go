@@ -0,0 +1,21 @@
+package config
+
+import "strconv"
+
+// SetTcpApplicationLimits stores the maxsession and maxthread attributes of the server conf, invalid values count as unset
+func (r *Rules) SetTcpApplicationLimits(maxSession, maxThread string) {
+	r.maxSession, _ = strconv.Atoi(maxSession)
+	r.maxThread, _ = strconv.Atoi(maxThread)
+
+	if r.maxSession < 0 {
+		r.maxSession = 0
+	}
+	if r.maxThread < 0 {
+		r.maxThread = 0
+	}
+}
+
+// GetTcpApplicationLimits returns the max sessions and max threads allowed by the server, 0 means no limit
+func (r *Rules) GetTcpApplicationLimits() (int, int) {
+	return r.maxSession, r.maxThread
+}
@@ -0,0 +1,286 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"EasierConnect/core/config"
+)
+
+const (
+	ConnConnecting  = "connecting"
+	ConnEstablished = "established"
+)
+
+var ErrConnNotFound = errors.New("no such connection")
+
+// ConnInfo snapshot of a tracked connection
+type ConnInfo struct {
+	ID       uint64
+	Listener string // socks5, http
+	Network  string
+	Client   string
+	Target   string // as requested by the client
+	Ip       string // resolved address, empty if the resolution failed
+	Route    config.RouteAction
+	Rule     string
+	Start    time.Time
+	Up       uint64 // bytes sent to the target
+	Down     uint64 // bytes received from the target
+	State    string
+}
+
+// connMeta who asked for a connection, carried by the context given to myDialer
+type connMeta struct {
+	listener   string
+	client     string
+	clientConn io.Closer // closed too when the connection is killed, may be nil
+}
+
+type connMetaKey struct{}
+
+func withConnMeta(ctx context.Context, listener string, client string, clientConn io.Closer) context.Context {
+	return context.WithValue(ctx, connMetaKey{}, &connMeta{listener: listener, client: client, clientConn: clientConn})
+}
+
+// trackedConn the remote side of a proxied connection, counting the bytes and leaving the table when closed
+type trackedConn struct {
+	net.Conn
+
+	table *ConnTable
+	meta  *connMeta
+
+	lock sync.Mutex
+	info ConnInfo
+
+	up   uint64
+	down uint64
+
+	closeReason string
+	closeOnce   sync.Once
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.down, uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.up, uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.table.closed(c)
+	})
+
+	if c.Conn == nil {
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// setRoute records how the target is reached, c may be nil for untracked connections
+func (c *trackedConn) setRoute(ip net.IP, route config.RouteAction, rule string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ip != nil {
+		c.info.Ip = ip.String()
+	}
+	c.info.Route = route
+	c.info.Rule = rule
+}
+
+func (c *trackedConn) established(conn net.Conn) net.Conn {
+	c.lock.Lock()
+	c.Conn = conn
+	c.info.State = ConnEstablished
+	c.lock.Unlock()
+
+	return c
+}
+
+func (c *trackedConn) snapshot() ConnInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	info := c.info
+	info.Up = atomic.LoadUint64(&c.up)
+	info.Down = atomic.LoadUint64(&c.down)
+	return info
+}
+
+// setCloseReason records why the connection ends, the first reason wins
+func (c *trackedConn) setCloseReason(reason string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+}
+
+func (c *trackedConn) kill() {
+	c.setCloseReason("killed")
+
+	c.lock.Lock()
+	conn := c.Conn
+	c.lock.Unlock()
+
+	if conn != nil {
+		_ = conn.Close()
+	}
+	if c.meta.clientConn != nil {
+		_ = c.meta.clientConn.Close()
+	}
+	c.closeOnce.Do(func() {
+		c.table.closed(c)
+	})
+}
+
+// ConnTable the connections currently proxied by the socks5 and http servers
+type ConnTable struct {
+	lock   sync.Mutex
+	conns  map[uint64]*trackedConn
+	nextId uint64
+
+	// every closed connection is written to it, nil to disable
+	accessLog *AccessLog
+
+	limiter *connLimiter
+}
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{conns: map[uint64]*trackedConn{}, limiter: newConnLimiter()}
+}
+
+// open adds a connection, ErrConnLimited if the client may not open another one now
+func (t *ConnTable) open(meta *connMeta, network string, target string) (*trackedConn, error) {
+	if err := t.limiter.acquire(meta.client); err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.nextId++
+	c := &trackedConn{
+		table: t,
+		meta:  meta,
+		info: ConnInfo{
+			ID:       t.nextId,
+			Listener: meta.listener,
+			Network:  network,
+			Client:   meta.client,
+			Target:   target,
+			Start:    time.Now(),
+			State:    ConnConnecting,
+		},
+	}
+	t.conns[c.info.ID] = c
+
+	return c, nil
+}
+
+func (t *ConnTable) closed(c *trackedConn) {
+	t.lock.Lock()
+	delete(t.conns, c.info.ID)
+	accessLog := t.accessLog
+	t.lock.Unlock()
+
+	t.limiter.release(c.info.Client)
+
+	if accessLog == nil {
+		return
+	}
+
+	info := c.snapshot()
+
+	c.lock.Lock()
+	reason := c.closeReason
+	c.lock.Unlock()
+	if reason == "" {
+		reason = "closed"
+	}
+
+	accessLog.Log(&AccessLogRecord{
+		Time:        time.Now(),
+		Listener:    info.Listener,
+		Network:     info.Network,
+		Client:      info.Client,
+		Target:      info.Target,
+		Ip:          info.Ip,
+		Route:       string(info.Route),
+		Rule:        info.Rule,
+		BytesUp:     info.Up,
+		BytesDown:   info.Down,
+		DurationMs:  time.Since(info.Start).Milliseconds(),
+		CloseReason: reason,
+	})
+}
+
+// SetLimits caps the connections opened from now on
+func (t *ConnTable) SetLimits(limits ConnLimits) {
+	t.limiter.setLimits(limits)
+}
+
+func (t *ConnTable) Limits() ConnLimits {
+	return t.limiter.getLimits()
+}
+
+func (t *ConnTable) SetAccessLog(accessLog *AccessLog) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.accessLog = accessLog
+}
+
+// List returns the open connections, oldest first
+func (t *ConnTable) List() []ConnInfo {
+	t.lock.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.lock.Unlock()
+
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.snapshot())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	return infos
+}
+
+// Kill closes both sides of a connection
+func (t *ConnTable) Kill(id uint64) error {
+	t.lock.Lock()
+	c, ok := t.conns[id]
+	t.lock.Unlock()
+
+	if !ok {
+		return ErrConnNotFound
+	}
+
+	c.kill()
+	return nil
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Connections returns the connections currently proxied, oldest first
+func (client *EasyConnectClient) Connections() ([]ConnInfo, error) {
+	h := client.tunnelHandle()
+	if h == nil {
+		return nil, ErrTunnelNotStarted
+	}
+
+	return h.conns.List(), nil
+}
+
+// KillConnection closes a proxied connection, id as listed by Connections
+func (client *EasyConnectClient) KillConnection(id uint64) error {
+	h := client.tunnelHandle()
+	if h == nil {
+		return ErrTunnelNotStarted
+	}
+
+	return h.conns.Kill(id)
+}
+
+// DeniedClients returns how many connections or packets each listener refused because of the client acl
+func (client *EasyConnectClient) DeniedClients() map[string]uint64 {
+	return client.clientAcl.Denied()
+}
+
+// LearnedRules returns the routes learned by the smart routing, nil when it is disabled
+func (client *EasyConnectClient) LearnedRules() *LearnedRules {
+	return client.learnedRules
+}
+
+// SocksUsers returns the accounting of the socks5 users, nil when auth is disabled
+func (client *EasyConnectClient) SocksUsers() map[string]SocksUserStats {
+	if client.socksAuth == nil {
+		return nil
+	}
+
+	return client.socksAuth.Stats()
+}
+
+func printConnections(w io.Writer, conns []ConnInfo) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tLISTENER\tCLIENT\tTARGET\tIP\tROUTE\tSTATE\tAGE\tUP\tDOWN")
+	for _, c := range conns {
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s/%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			c.ID, c.Listener, c.Client, c.Target, c.Network, c.Ip, c.Route, c.State,
+			time.Since(c.Start).Truncate(time.Second), c.Up, c.Down)
+	}
+	_ = tw.Flush()
+}
+
+// ServeConsole runs the commands read line by line from r until it is closed
+func (client *EasyConnectClient) ServeConsole(r io.Reader, w io.Writer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "connections", "conns":
+			conns, err := client.Connections()
+			if err != nil {
+				_, _ = fmt.Fprintln(w, err.Error())
+				continue
+			}
+			printConnections(w, conns)
+		case "kill":
+			if len(fields) != 2 {
+				_, _ = fmt.Fprintln(w, "usage: kill <id>")
+				continue
+			}
+
+			id, err := strconv.ParseUint(fields[1], 10, 64)
+			if err == nil {
+				err = client.KillConnection(id)
+			}
+
+			if err != nil {
+				_, _ = fmt.Fprintln(w, err.Error())
+			} else {
+				_, _ = fmt.Fprintf(w, "connection %d killed\n", id)
+			}
+		case "denied":
+			denied := client.DeniedClients()
+			if len(denied) == 0 {
+				_, _ = fmt.Fprintln(w, "no client denied")
+				continue
+			}
+			for _, listener := range sortedListeners(denied) {
+				_, _ = fmt.Fprintf(w, "%s: %d\n", listener, denied[listener])
+			}
+		case "users":
+			users := client.SocksUsers()
+			if users == nil {
+				_, _ = fmt.Fprintln(w, "socks5 auth is disabled")
+				continue
+			}
+
+			usernames := make([]string, 0, len(users))
+			for username := range users {
+				usernames = append(usernames, username)
+			}
+			sort.Strings(usernames)
+
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(tw, "USER\tACTIVE\tTOTAL\tFAILED")
+			for _, username := range usernames {
+				stats := users[username]
+				_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", username, stats.Active, stats.Total, stats.Failed)
+			}
+			_ = tw.Flush()
+		case "learned":
+			learned := client.LearnedRules()
+			if learned == nil {
+				_, _ = fmt.Fprintln(w, "smart routing is disabled")
+				continue
+			}
+
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			_, _ = fmt.Fprintln(tw, "HOST\tROUTE\tEXPIRES")
+			for _, rule := range learned.List() {
+				_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", rule.Host, rule.Action, rule.Expires.Format(time.RFC3339))
+			}
+			_ = tw.Flush()
+		case "forget":
+			if len(fields) != 2 {
+				_, _ = fmt.Fprintln(w, "usage: forget <host>")
+				continue
+			}
+
+			if learned := client.LearnedRules(); learned != nil && learned.Forget(fields[1]) {
+				_, _ = fmt.Fprintf(w, "%s forgotten\n", fields[1])
+			} else {
+				_, _ = fmt.Fprintf(w, "no learned rule for %s\n", fields[1])
+			}
+		case "help":
+			_, _ = fmt.Fprintln(w, "commands:\n  connections    list the proxied connections\n  kill <id>      close a connection\n  denied         count the clients refused by the acl\n  users          socks5 connections and failed logins per user\n  learned        list the routes learned by the smart routing\n  forget <host>  drop a learned route")
+		default:
+			_, _ = fmt.Fprintf(w, "unknown command: %s, try help\n", fields[0])
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+var ErrTunnelNotStarted = errors.New("tunnel not started, call StartTunnel first")
+
+// DialContext connects to addr the same way the socks5 server does:
+// targets matching the server rules go through the tunnel, everything else is dialed directly.
+func (client *EasyConnectClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	h := client.tunnelHandle()
+	if h == nil {
+		return nil, ErrTunnelNotStarted
+	}
+
+	switch network {
+	case "tcp", "tcp4":
+		return h.myDialer(ctx, "tcp", nil, addr)
+	case "udp", "udp4":
+		return h.myDialer(ctx, "udp", nil, addr)
+	}
+
+	return nil, errors.New("unsupported network: " + network)
+}
+
+func (client *EasyConnectClient) Dial(network, addr string) (net.Conn, error) {
+	return client.DialContext(context.Background(), network, addr)
+}
+
+// Listen accepts tcp connections on the virtual ip assigned by the server, so intranet hosts can connect back.
+func (client *EasyConnectClient) Listen(network, addr string) (net.Listener, error) {
+	h := client.tunnelHandle()
+	if h == nil {
+		return nil, ErrTunnelNotStarted
+	}
+
+	if network != "tcp" && network != "tcp4" {
+		return nil, errors.New("unsupported network: " + network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.Equal(net.IP(client.clientIp))) {
+		return nil, errors.New("can only listen on the virtual ip: " + net.IP(client.clientIp).String())
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid port: " + portStr)
+	}
+
+	bind := tcpip.FullAddress{
+		NIC:  defaultNIC,
+		Port: uint16(port),
+		Addr: tcpip.Address(client.clientIp),
+	}
+
+	return gonet.ListenTCP(h.ipStack, bind, header.IPv4ProtocolNumber)
+}
+
+// Resolver returns a resolver using the dns upstreams of the socks server, nil if the tunnel is not started.
+func (client *EasyConnectClient) Resolver() *net.Resolver {
+	h := client.tunnelHandle()
+	if h == nil {
+		return nil
+	}
+
+	return h.resolver.Load().NetResolver()
+}
+
+// HTTPTransport returns a http.Transport dialing through DialContext, usable as a drop-in for http.Client.
+func (client *EasyConnectClient) HTTPTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:           client.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsCacheMinTTL = 5 * time.Second
+	dnsCacheMaxTTL = time.Hour
+
+	// ttl of failed lookups without a SOA record, and of the system resolver answers which carry no ttl
+	dnsNegativeTTL = 30 * time.Second
+	dnsSystemTTL   = time.Minute
+)
+
+// dnsLookupFunc resolves domain, returning the ttl of the answer (also for not found errors)
+type dnsLookupFunc func(domain string) ([]net.IP, time.Duration, error)
+
+type dnsCacheEntry struct {
+	domain string
+	ips    []net.IP
+	err    error
+
+	ttl         time.Duration
+	expire      time.Time
+	prefetching bool
+
+	elem *list.Element
+}
+
+// dnsLookup a lookup in progress, concurrent misses of the same domain wait for it instead of querying again
+type dnsLookup struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// DnsCache caches resolved addresses for the ttl of their records, names that do not exist are cached too.
+// Entries used shortly before expiring are refreshed in the background.
+type DnsCache struct {
+	lock     sync.Mutex
+	entries  map[string]*dnsCacheEntry
+	lru      *list.List // most recently used first
+	inflight map[string]*dnsLookup
+	maxSize  int
+}
+
+// NewDnsCache creates a cache holding up to maxSize domains, nil (no caching) if maxSize <= 0
+func NewDnsCache(maxSize int) *DnsCache {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	return &DnsCache{
+		entries:  map[string]*dnsCacheEntry{},
+		lru:      list.New(),
+		inflight: map[string]*dnsLookup{},
+		maxSize:  maxSize,
+	}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// Lookup returns the cached answer for domain, calling fetch on a miss
+func (c *DnsCache) Lookup(domain string, fetch dnsLookupFunc) ([]net.IP, error) {
+	if c == nil {
+		ips, _, err := fetch(domain)
+		return ips, err
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	c.lock.Lock()
+	if entry, ok := c.entries[domain]; ok {
+		now := time.Now()
+		if now.Before(entry.expire) {
+			c.lru.MoveToFront(entry.elem)
+
+			if entry.err == nil && !entry.prefetching && entry.expire.Sub(now) < entry.ttl/10 {
+				entry.prefetching = true
+				go c.fetch(domain, fetch)
+			}
+
+			ips, err := entry.ips, entry.err
+			c.lock.Unlock()
+			return ips, err
+		}
+	}
+	c.lock.Unlock()
+
+	return c.fetch(domain, fetch)
+}
+
+func (c *DnsCache) fetch(domain string, fetch dnsLookupFunc) ([]net.IP, error) {
+	c.lock.Lock()
+	if l, ok := c.inflight[domain]; ok {
+		c.lock.Unlock()
+		<-l.done
+		return l.ips, l.err
+	}
+
+	l := &dnsLookup{done: make(chan struct{})}
+	c.inflight[domain] = l
+	c.lock.Unlock()
+
+	ips, ttl, err := fetch(domain)
+	l.ips, l.err = ips, err
+
+	c.lock.Lock()
+	delete(c.inflight, domain)
+	if err == nil || isNotFound(err) {
+		c.store(domain, ips, ttl, err)
+	} else if entry, ok := c.entries[domain]; ok {
+		// failed prefetch, the current answer stays until it expires
+		entry.prefetching = false
+	}
+	c.lock.Unlock()
+
+	close(l.done)
+
+	return ips, err
+}
+
+// store must be called with the lock held
+func (c *DnsCache) store(domain string, ips []net.IP, ttl time.Duration, err error) {
+	if ttl < dnsCacheMinTTL {
+		ttl = dnsCacheMinTTL
+	} else if ttl > dnsCacheMaxTTL {
+		ttl = dnsCacheMaxTTL
+	}
+
+	entry, ok := c.entries[domain]
+	if !ok {
+		entry = &dnsCacheEntry{domain: domain}
+		entry.elem = c.lru.PushFront(entry)
+		c.entries[domain] = entry
+	} else {
+		c.lru.MoveToFront(entry.elem)
+	}
+
+	entry.ips = ips
+	entry.err = err
+	entry.ttl = ttl
+	entry.expire = time.Now().Add(ttl)
+	entry.prefetching = false
+
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Remove(c.lru.Back()).(*dnsCacheEntry)
+		delete(c.entries, oldest.domain)
+	}
+}
+
+// Flush drops every cached answer
+func (c *DnsCache) Flush() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = map[string]*dnsCacheEntry{}
+	c.lru.Init()
+}
+
+func (c *DnsCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.lru.Len()
+}
+
+// negativeTTL how long a name that does not exist may be cached, from the SOA record of the reply
+func negativeTTL(msg *dnsmessage.Message) time.Duration {
+	for _, authority := range msg.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			ttl := soa.MinTTL
+			if authority.Header.TTL < ttl {
+				ttl = authority.Header.TTL
+			}
+			return time.Duration(ttl) * time.Second
+		}
+	}
+
+	return dnsNegativeTTL
+}
+
+// queryA asks for the ipv4 addresses of domain, the ttl is the smallest one of the answer
+func queryA(exchange func(query []byte) ([]byte, error), domain string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(domain, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+
+	raw, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reply, err := exchange(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var msg dnsmessage.Message
+	if err = msg.Unpack(reply); err != nil {
+		return nil, 0, err
+	}
+
+	if msg.ID != id {
+		return nil, 0, errors.New("dns reply id mismatch")
+	}
+
+	notFound := &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL(&msg), notFound
+	default:
+		return nil, 0, errors.New("dns server returned " + msg.RCode.String())
+	}
+
+	var ips []net.IP
+	ttl := uint32(math.MaxUint32)
+	for _, answer := range msg.Answers {
+		if answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+
+		if a, ok := answer.Body.(*dnsmessage.AResource); ok {
+			ips = append(ips, net.IPv4(a.A[0], a.A[1], a.A[2], a.A[3]).To4())
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, negativeTTL(&msg), notFound
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
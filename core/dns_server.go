@@ -0,0 +1,258 @@
+package core
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ttl of the answers built from the rclist dns rules, these have no ttl of their own
+const dnsRuleTTL = 300
+
+// largest udp reply of a client without EDNS (RFC 1035 section 4.2.1)
+const dnsUdpMaxSize = 512
+
+// DnsServer answers from the rclist dns rules first, everything else goes through the resolver chain:
+// intranet names to the server's dns through the tunnel, the others to the public upstreams.
+type DnsServer struct {
+	handle *DefaultHandle
+}
+
+func NewDnsServer(h *DefaultHandle) *DnsServer {
+	return &DnsServer{
+		handle: h,
+	}
+}
+
+// reverseName converts a in-addr.arpa name back to the ipv4 address, empty if it is not one
+func reverseName(name string) string {
+	if !strings.HasSuffix(name, ".in-addr.arpa") {
+		return ""
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+	if len(labels) != 4 {
+		return ""
+	}
+
+	return labels[3] + "." + labels[2] + "." + labels[1] + "." + labels[0]
+}
+
+// answerFromRules builds a reply from the rclist dns rules, nil if there is no rule for the name
+func (d *DnsServer) answerFromRules(query *dnsmessage.Message, name string) []byte {
+	q := query.Questions[0]
+	if q.Class != dnsmessage.ClassINET {
+		return nil
+	}
+
+	if !d.handle.rules.IsDnsRuleAvailable() || d.handle.rules.IsDnsRuleException(name) {
+		return nil
+	}
+
+	ipString, ok := d.handle.rules.GetSingleDnsRule(name)
+	if !ok {
+		return nil
+	}
+
+	ip := net.ParseIP(ipString).To4()
+	if ip == nil {
+		return nil
+	}
+
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+
+	// the rule overrides the name: only ipv4 is available through the tunnel, AAAA gets an empty answer so clients
+	// fall back to A, and so do the other types, the upstream answers would contradict the rule
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		reply.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: dnsRuleTTL},
+			Body:   &a,
+		}}
+	}
+
+	packed, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
+
+func errorReply(query *dnsmessage.Message, rcode dnsmessage.RCode) []byte {
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: query.Questions,
+	}
+
+	packed, _ := reply.Pack()
+	return packed
+}
+
+// Resolve answers a raw dns query
+func (d *DnsServer) Resolve(raw []byte) ([]byte, error) {
+	var query dnsmessage.Message
+	if err := query.Unpack(raw); err != nil {
+		return nil, err
+	}
+
+	if len(query.Questions) == 0 {
+		return errorReply(&query, dnsmessage.RCodeFormatError), nil
+	}
+
+	q := query.Questions[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+
+	if reply := d.answerFromRules(&query, name); reply != nil {
+		if DebugDump {
+			log.Printf("dns: %s %s answered from dns rules", q.Type, name)
+		}
+		return reply, nil
+	}
+
+	reply, err := d.handle.resolver.Load().ExchangeSplit(raw)
+	if err != nil {
+		log.Printf("dns: %s %s failed: %s", q.Type, name, err.Error())
+		return errorReply(&query, dnsmessage.RCodeServerFailure), nil
+	}
+
+	return reply, nil
+}
+
+// truncateUdpReply cuts a reply larger than the client accepts over udp to its question with TC set,
+// the client retries over tcp. The reply may come from a tcp upstream, so it can be of any size.
+func truncateUdpReply(rawQuery []byte, reply []byte) []byte {
+	maxSize := dnsUdpMaxSize
+
+	var query dnsmessage.Message
+	if err := query.Unpack(rawQuery); err == nil {
+		for _, additional := range query.Additionals {
+			// the class of an OPT record is the udp payload size of the sender (RFC 6891 section 6.1.2)
+			if additional.Header.Type == dnsmessage.TypeOPT && int(additional.Header.Class) > maxSize {
+				maxSize = int(additional.Header.Class)
+			}
+		}
+	}
+
+	if len(reply) <= maxSize {
+		return reply
+	}
+
+	var message dnsmessage.Message
+	if err := message.Unpack(reply); err != nil {
+		return errorReply(&query, dnsmessage.RCodeServerFailure)
+	}
+
+	truncated := dnsmessage.Message{Header: message.Header, Questions: message.Questions}
+	truncated.Truncated = true
+	for _, additional := range message.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			truncated.Additionals = append(truncated.Additionals, additional)
+		}
+	}
+
+	packed, err := truncated.Pack()
+	if err != nil {
+		return errorReply(&query, dnsmessage.RCodeServerFailure)
+	}
+	return packed
+}
+
+func (d *DnsServer) serveUdp(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("DNS udp server stopped: %s", err.Error())
+			return
+		}
+
+		if !d.handle.acl.Check("dns", addr) {
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		go func(addr net.Addr, query []byte) {
+			reply, err := d.Resolve(query)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(truncateUdpReply(query, reply), addr)
+		}(addr, query)
+	}
+}
+
+func (d *DnsServer) serveTcpConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		if err := conn.SetDeadline(time.Now().Add(30 * time.Second)); err != nil {
+			return
+		}
+
+		query, err := readStreamMessage(conn)
+		if err != nil {
+			return
+		}
+
+		reply, err := d.Resolve(query)
+		if err != nil {
+			return
+		}
+
+		if err = writeStreamMessage(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (d *DnsServer) ListenAndServe(bindAddr string) error {
+	udpConn, err := net.ListenPacket("udp", bindAddr)
+	if err != nil {
+		return err
+	}
+
+	tcpListener, err := listen("dns", bindAddr, d.handle.acl)
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+
+	log.Printf("DNS server listening on %s (udp/tcp)", bindAddr)
+
+	go d.serveUdp(udpConn)
+
+	for {
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			return err
+		}
+		go d.serveTcpConn(conn)
+	}
+}
+
+func ServeDns(h *DefaultHandle, bindAddr string) {
+	if err := NewDnsServer(h).ListenAndServe(bindAddr); err != nil {
+		log.Printf("DNS server stopped: %s", err.Error())
+	}
+}
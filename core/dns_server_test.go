@@ -0,0 +1,159 @@
+package core
+
+import (
+	"EasierConnect/core/config"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsQuery(t *testing.T, name string, qtype dnsmessage.Type, udpSize int) []byte {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+
+	if udpSize > 0 {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		query.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+// dnsReply a reply to query with answers A records
+func dnsReply(t *testing.T, rawQuery []byte, answers int) []byte {
+	var query dnsmessage.Message
+	if err := query.Unpack(rawQuery); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: query.ID, Response: true, RecursionDesired: true, RecursionAvailable: true},
+		Questions:   query.Questions,
+		Additionals: query.Additionals,
+	}
+	for i := 0; i < answers; i++ {
+		reply.Answers = append(reply.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{10, 0, byte(i >> 8), byte(i)}},
+		})
+	}
+
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func TestTruncateUdpReply(t *testing.T) {
+	tests := []struct {
+		name      string
+		udpSize   int
+		answers   int
+		truncated bool
+	}{
+		{"small reply without edns", 0, 5, false},
+		{"large reply without edns", 0, 100, true},
+		{"large reply within the edns size", 4096, 100, false},
+		{"reply over the edns size", 1232, 200, true},
+		// a size below 512 is taken as 512 (RFC 6891 section 6.2.5)
+		{"edns size below the minimum", 256, 20, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dnsQuery(t, "big.example.com.", dnsmessage.TypeA, tt.udpSize)
+			reply := dnsReply(t, query, tt.answers)
+
+			got := truncateUdpReply(query, reply)
+
+			var message dnsmessage.Message
+			if err := message.Unpack(got); err != nil {
+				t.Fatal(err)
+			}
+
+			if message.Truncated != tt.truncated {
+				t.Fatalf("Truncated = %v, want %v (reply of %d bytes)", message.Truncated, tt.truncated, len(reply))
+			}
+
+			limit := 512
+			if tt.udpSize > limit {
+				limit = tt.udpSize
+			}
+			if len(got) > limit {
+				t.Errorf("reply of %d bytes, over the %d bytes of the client", len(got), limit)
+			}
+
+			if !tt.truncated {
+				if string(got) != string(reply) {
+					t.Error("a reply within the size was modified")
+				}
+				return
+			}
+
+			if message.ID != 42 || len(message.Questions) != 1 || len(message.Answers) != 0 {
+				t.Errorf("truncated reply = %+v, want the question only", message)
+			}
+			if (tt.udpSize > 0) != (len(message.Additionals) == 1) {
+				t.Errorf("the OPT record of the reply was not kept: %v", message.Additionals)
+			}
+		})
+	}
+}
+
+func TestAnswerFromRulesOverridesEveryType(t *testing.T) {
+	rules := config.NewRules()
+	rules.AppendSingleDnsRule("intra.example.com", "10.1.2.3", false)
+	d := NewDnsServer(&DefaultHandle{rules: rules})
+
+	tests := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		answers int
+	}{
+		{"intra.example.com.", dnsmessage.TypeA, 1},
+		{"intra.example.com.", dnsmessage.TypeAAAA, 0},
+		{"intra.example.com.", dnsmessage.TypeMX, 0},
+		{"intra.example.com.", dnsmessage.TypeTXT, 0},
+		{"intra.example.com.", dnsmessage.Type(65), 0}, // HTTPS
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.qtype.String(), func(t *testing.T) {
+			var query dnsmessage.Message
+			if err := query.Unpack(dnsQuery(t, tt.name, tt.qtype, 0)); err != nil {
+				t.Fatal(err)
+			}
+
+			raw := d.answerFromRules(&query, "intra.example.com")
+			if raw == nil {
+				t.Fatal("no answer from the dns rule")
+			}
+
+			var reply dnsmessage.Message
+			if err := reply.Unpack(raw); err != nil {
+				t.Fatal(err)
+			}
+			if reply.RCode != dnsmessage.RCodeSuccess || len(reply.Answers) != tt.answers {
+				t.Errorf("reply %s with %d answers, want NOERROR with %d", reply.RCode, len(reply.Answers), tt.answers)
+			}
+		})
+	}
+
+	var query dnsmessage.Message
+	if err := query.Unpack(dnsQuery(t, "other.example.com.", dnsmessage.TypeMX, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if d.answerFromRules(&query, "other.example.com") != nil {
+		t.Error("answered a name without dns rule")
+	}
+}
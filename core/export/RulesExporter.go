@@ -0,0 +1,416 @@
+package export
+
+import (
+	"EasierConnect/core/config"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	FormatClash   = "clash"
+	FormatSingBox = "sing-box"
+	FormatSurge   = "surge"
+	FormatAll     = "all"
+)
+
+// portRange {min, max}, {1, 65535} means no port restriction
+type portRange [2]int
+
+func (p portRange) any() bool {
+	return p[0] <= 1 && p[1] >= 65535
+}
+
+func (p portRange) String() string {
+	if p[0] == p[1] {
+		return fmt.Sprintf("%d", p[0])
+	}
+	return fmt.Sprintf("%d-%d", p[0], p[1])
+}
+
+type ruleGroup struct {
+	ports    portRange
+	domains  []string
+	suffixes []string // `*.x` rules, exported as x
+	keywords []string
+	cidrs    []string
+	anyHost  bool // a local port rule, every host on these ports
+}
+
+// ruleSet intermediate representation shared by all formats, grouped by port range
+type ruleSet struct {
+	groups   []*ruleGroup
+	hosts    map[string]string
+	allSites *portRange
+}
+
+func (s *ruleSet) group(ports []int) *ruleGroup {
+	key := portRange{1, 65535}
+	if len(ports) >= 2 {
+		key = portRange{ports[0], ports[1]}
+	}
+
+	for _, g := range s.groups {
+		if g.ports == key {
+			return g
+		}
+	}
+
+	g := &ruleGroup{ports: key}
+	s.groups = append(s.groups, g)
+	return g
+}
+
+func buildRuleSet(rules *config.Rules) *ruleSet {
+	set := &ruleSet{hosts: map[string]string{}}
+
+	rules.RangeDomainRules(func(domain string, ports []int) bool {
+		switch {
+		case domain == "*":
+			p := portRange{ports[0], ports[1]}
+			set.allSites = &p
+			log.Printf("export: the server allows all web sites (ports %s), add a final rule to the vpn yourself", p)
+		case domain == "" || strings.ContainsAny(domain, "/:"):
+			// raw url rules, the pure domain is stored as a separate rule
+		case strings.HasPrefix(domain, "*."):
+			g := set.group(ports)
+			g.suffixes = append(g.suffixes, domain[2:])
+		case net.ParseIP(domain) != nil:
+			g := set.group(ports)
+			g.cidrs = append(g.cidrs, domain+"/32")
+		default:
+			g := set.group(ports)
+			g.domains = append(g.domains, domain)
+		}
+		return true
+	})
+
+	if rules.IsIpv4RuleAvailable() {
+		for _, rule := range *rules.GetIpv4Rules() {
+			from, to := rule.Range()
+			g := set.group(rule.Ports)
+			for _, cidr := range config.Ipv4RangeToCIDRs(from, to) {
+				g.cidrs = append(g.cidrs, cidr.String())
+			}
+		}
+	}
+
+	rules.RangeDnsRules(func(domain, ip string) bool {
+		if !rules.IsDnsRuleException(domain) {
+			set.hosts[domain] = ip
+		}
+		return true
+	})
+
+	set.sort()
+
+	return set
+}
+
+func (s *ruleSet) sort() {
+	sort.Slice(s.groups, func(i, j int) bool {
+		if s.groups[i].ports[0] != s.groups[j].ports[0] {
+			return s.groups[i].ports[0] < s.groups[j].ports[0]
+		}
+		return s.groups[i].ports[1] < s.groups[j].ports[1]
+	})
+
+	for _, g := range s.groups {
+		sort.Strings(g.domains)
+		sort.Strings(g.suffixes)
+		sort.Strings(g.keywords)
+		sort.Strings(g.cidrs)
+	}
+}
+
+func (s *ruleSet) addLocalRule(rule *config.LocalRule) {
+	g := s.group(rule.Ports)
+
+	switch rule.Type {
+	case config.LocalRuleDomain:
+		g.domains = append(g.domains, rule.Value)
+	case config.LocalRuleDomainSuffix:
+		g.suffixes = append(g.suffixes, rule.Value)
+	case config.LocalRuleKeyword:
+		g.keywords = append(g.keywords, rule.Value)
+	case config.LocalRuleCIDR:
+		g.cidrs = append(g.cidrs, rule.CIDR().String())
+	case config.LocalRulePort:
+		g.anyHost = true
+	}
+}
+
+// addLocalRules merges the local vpn rules into set, the direct and reject ones are returned as separate sets
+func addLocalRules(set *ruleSet, localRules *config.LocalRules) map[config.RouteAction]*ruleSet {
+	local := map[config.RouteAction]*ruleSet{}
+	if localRules == nil {
+		return local
+	}
+
+	for _, rule := range localRules.Rules() {
+		target := set
+		if rule.Action != config.ActionVpn {
+			if local[rule.Action] == nil {
+				local[rule.Action] = &ruleSet{hosts: map[string]string{}}
+			}
+			target = local[rule.Action]
+		}
+		target.addLocalRule(rule)
+	}
+
+	set.sort()
+	for _, s := range local {
+		s.sort()
+	}
+
+	if len(local) > 0 {
+		log.Printf("export: local rules are evaluated %s the server rules, order the local direct/reject rule sets the same way", localRules.Policy)
+	}
+
+	return local
+}
+
+func sortedHosts(hosts map[string]string) []string {
+	keys := make([]string, 0, len(hosts))
+	for k := range hosts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// classicalRules rules in the `TYPE,value` syntax shared by clash and surge
+func classicalRules(set *ruleSet, portKeyword string) []string {
+	var lines []string
+
+	wrap := func(rule string, ports portRange) string {
+		if ports.any() {
+			return rule
+		}
+		return fmt.Sprintf("AND,((%s),(%s,%s))", rule, portKeyword, ports)
+	}
+
+	for _, g := range set.groups {
+		for _, domain := range g.domains {
+			lines = append(lines, wrap("DOMAIN,"+domain, g.ports))
+		}
+		for _, suffix := range g.suffixes {
+			lines = append(lines, wrap("DOMAIN-SUFFIX,"+suffix, g.ports))
+		}
+		for _, keyword := range g.keywords {
+			lines = append(lines, wrap("DOMAIN-KEYWORD,"+keyword, g.ports))
+		}
+		for _, cidr := range g.cidrs {
+			ruleType := "IP-CIDR,"
+			if strings.Contains(cidr, ":") {
+				ruleType = "IP-CIDR6,"
+			}
+
+			if g.ports.any() {
+				lines = append(lines, ruleType+cidr+",no-resolve")
+			} else {
+				lines = append(lines, wrap(ruleType+cidr, g.ports))
+			}
+		}
+		if g.anyHost {
+			lines = append(lines, fmt.Sprintf("%s,%s", portKeyword, g.ports))
+		}
+	}
+
+	return lines
+}
+
+func yamlQuote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func clashRules(set *ruleSet) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("# rule-provider generated by EasierConnect (behavior: classical)\npayload:\n")
+	for _, line := range classicalRules(set, "DST-PORT") {
+		sb.WriteString("  - " + yamlQuote(line) + "\n")
+	}
+	return sb.String(), nil
+}
+
+func exportClash(set *ruleSet, local map[config.RouteAction]*ruleSet, outDir string) error {
+	if err := writeRuleSets(set, local, outDir, "clash", ".yaml", clashRules); err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("# dns overrides generated by EasierConnect, merge into the `hosts` section of your config\nhosts:\n")
+	for _, domain := range sortedHosts(set.hosts) {
+		sb.WriteString("  " + yamlQuote(domain) + ": " + yamlQuote(set.hosts[domain]) + "\n")
+	}
+
+	return writeFile(outDir, "clash-hosts.yaml", sb.String())
+}
+
+func surgeRules(set *ruleSet) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("# rule set generated by EasierConnect\n")
+	for _, line := range classicalRules(set, "DEST-PORT") {
+		sb.WriteString(line + "\n")
+	}
+	return sb.String(), nil
+}
+
+func exportSurge(set *ruleSet, local map[config.RouteAction]*ruleSet, outDir string) error {
+	if err := writeRuleSets(set, local, outDir, "surge", ".list", surgeRules); err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("# dns overrides generated by EasierConnect\n[Host]\n")
+	for _, domain := range sortedHosts(set.hosts) {
+		sb.WriteString(domain + " = " + set.hosts[domain] + "\n")
+	}
+
+	return writeFile(outDir, "surge-hosts.conf", sb.String())
+}
+
+func singBoxRules(set *ruleSet) (string, error) {
+	type headlessRule struct {
+		Domain        []string `json:"domain,omitempty"`
+		DomainSuffix  []string `json:"domain_suffix,omitempty"`
+		DomainKeyword []string `json:"domain_keyword,omitempty"`
+		IpCidr        []string `json:"ip_cidr,omitempty"`
+		PortRange     []string `json:"port_range,omitempty"`
+	}
+
+	var rules []headlessRule
+	for _, g := range set.groups {
+		var portRange []string
+		if !g.ports.any() {
+			portRange = []string{fmt.Sprintf("%d:%d", g.ports[0], g.ports[1])}
+		}
+
+		if len(g.domains) > 0 || len(g.suffixes) > 0 || len(g.keywords) > 0 || len(g.cidrs) > 0 {
+			rules = append(rules, headlessRule{Domain: g.domains, DomainSuffix: g.suffixes, DomainKeyword: g.keywords, IpCidr: g.cidrs, PortRange: portRange})
+		}
+		// the fields of a rule are and-ed with the ports, every host needs its own rule
+		if g.anyHost {
+			if portRange == nil {
+				portRange = []string{"1:65535"}
+			}
+			rules = append(rules, headlessRule{PortRange: portRange})
+		}
+	}
+
+	ruleSetJson, err := json.MarshalIndent(map[string]any{
+		"version": 1,
+		"rules":   rules,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(ruleSetJson) + "\n", nil
+}
+
+func exportSingBox(set *ruleSet, local map[config.RouteAction]*ruleSet, outDir string) error {
+	if err := writeRuleSets(set, local, outDir, "sing-box", ".json", singBoxRules); err != nil {
+		return err
+	}
+
+	domains := sortedHosts(set.hosts)
+	dnsJson, err := json.MarshalIndent(map[string]any{
+		"dns": map[string]any{
+			"servers": []any{
+				map[string]any{
+					"type":       "hosts",
+					"tag":        "easierconnect-hosts",
+					"predefined": set.hosts,
+				},
+			},
+			"rules": []any{
+				map[string]any{
+					"domain": domains,
+					"server": "easierconnect-hosts",
+				},
+			},
+		},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(outDir, "sing-box-dns.json", string(dnsJson)+"\n")
+}
+
+// writeRuleSets writes set as <prefix>-rules<ext>, and the local direct and reject rules as <prefix>-local-<action><ext>
+func writeRuleSets(set *ruleSet, local map[config.RouteAction]*ruleSet, outDir, prefix, ext string, render func(*ruleSet) (string, error)) error {
+	content, err := render(set)
+	if err != nil {
+		return err
+	}
+	if err = writeFile(outDir, prefix+"-rules"+ext, content); err != nil {
+		return err
+	}
+
+	for _, action := range []config.RouteAction{config.ActionDirect, config.ActionReject} {
+		if local[action] == nil {
+			continue
+		}
+
+		if content, err = render(local[action]); err != nil {
+			return err
+		}
+		if err = writeFile(outDir, prefix+"-local-"+string(action)+ext, content); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeFile(outDir, name, content string) error {
+	path := filepath.Join(outDir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return err
+	}
+
+	log.Printf("export: wrote %s", path)
+	return nil
+}
+
+// ExportRules writes the parsed rules as rule-provider files of the given format (clash, sing-box, surge or all) into outDir.
+// The local vpn rules are merged into them, the direct and reject ones get their own files. localRules may be nil.
+func ExportRules(rules *config.Rules, localRules *config.LocalRules, format string, outDir string) error {
+	var exports []func(*ruleSet, map[config.RouteAction]*ruleSet, string) error
+	switch format {
+	case FormatClash:
+		exports = append(exports, exportClash)
+	case FormatSingBox:
+		exports = append(exports, exportSingBox)
+	case FormatSurge:
+		exports = append(exports, exportSurge)
+	case FormatAll:
+		exports = append(exports, exportClash, exportSingBox, exportSurge)
+	default:
+		return errors.New("unknown export format: " + format)
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	set := buildRuleSet(rules)
+	local := addLocalRules(set, localRules)
+
+	for _, export := range exports {
+		if err := export(set, local, outDir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
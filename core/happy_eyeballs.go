@@ -0,0 +1,161 @@
+package core
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"EasierConnect/core/config"
+)
+
+// delay before the next address is tried while the previous attempt is still pending (RFC 8305)
+const dialAttemptDelay = 250 * time.Millisecond
+
+// how long an address that could not be connected to is tried last
+const failedAddrTTL = 30 * time.Second
+
+// dialCandidate one resolved address of a target and how the rules route it
+type dialCandidate struct {
+	ip     net.IP // nil if the resolution failed
+	action config.RouteAction
+	rule   string
+}
+
+type dialResult struct {
+	conn      net.Conn
+	candidate *dialCandidate
+	err       error
+}
+
+// failedAddrs addresses that recently failed to connect
+type failedAddrs struct {
+	lock  sync.Mutex
+	addrs map[string]time.Time
+}
+
+func newFailedAddrs() *failedAddrs {
+	return &failedAddrs{addrs: map[string]time.Time{}}
+}
+
+func (f *failedAddrs) add(addr string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := time.Now()
+	if len(f.addrs) >= 1024 {
+		for a, expiry := range f.addrs {
+			if now.After(expiry) {
+				delete(f.addrs, a)
+			}
+		}
+	}
+
+	f.addrs[addr] = now.Add(failedAddrTTL)
+}
+
+func (f *failedAddrs) remove(addr string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.addrs, addr)
+}
+
+func (f *failedAddrs) recent(addr string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	expiry, ok := f.addrs[addr]
+	if ok && time.Now().After(expiry) {
+		delete(f.addrs, addr)
+		return false
+	}
+	return ok
+}
+
+// sortCandidates moves the addresses that recently failed to the end, keeping the resolver order otherwise
+func (f *failedAddrs) sortCandidates(candidates []*dialCandidate, port string) []*dialCandidate {
+	sorted := make([]*dialCandidate, 0, len(candidates))
+	var failed []*dialCandidate
+
+	for _, c := range candidates {
+		if c.ip != nil && f.recent(net.JoinHostPort(c.ip.String(), port)) {
+			failed = append(failed, c)
+		} else {
+			sorted = append(sorted, c)
+		}
+	}
+
+	return append(sorted, failed...)
+}
+
+// dialParallel tries the candidates in order, starting the next one when the previous attempt failed
+// or did not finish within dialAttemptDelay. The first connection wins, the other attempts are cancelled.
+func dialParallel(ctx context.Context, candidates []*dialCandidate, dialOne func(context.Context, *dialCandidate) (net.Conn, error)) (net.Conn, *dialCandidate, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(candidates))
+	next := 0
+	pending := 0
+
+	start := func() {
+		c := candidates[next]
+		next++
+		pending++
+
+		go func() {
+			conn, err := dialOne(ctx, c)
+			results <- dialResult{conn: conn, candidate: c, err: err}
+		}()
+	}
+
+	start()
+
+	timer := time.NewTimer(dialAttemptDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(candidates) {
+				start()
+				timer.Reset(dialAttemptDelay)
+			}
+		case result := <-results:
+			pending--
+
+			if result.err == nil {
+				// attempts finishing after the winner are closed
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(pending)
+
+				return result.conn, result.candidate, nil
+			}
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+
+			// no need to wait for the delay once an attempt failed
+			if next < len(candidates) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				start()
+				timer.Reset(dialAttemptDelay)
+			}
+		}
+	}
+
+	return nil, nil, firstErr
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hop-by-hop headers, these are removed when forwarding (RFC 7230 section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type HttpProxyHandle struct {
+	handle    *DefaultHandle
+	transport *http.Transport
+
+	// the socks5 users, checked against Proxy-Authorization, nil if auth is disabled
+	auth *SocksAuth
+}
+
+func NewHttpProxyHandle(h *DefaultHandle, auth *SocksAuth) *HttpProxyHandle {
+	return &HttpProxyHandle{
+		handle: h,
+		auth:   auth,
+		transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return h.myDialer(ctx, "tcp", nil, addr)
+			},
+			// a pooled connection would stay tracked and limited as the client that opened it
+			DisableKeepAlives:     true,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, key := range strings.Split(v, ",") {
+			header.Del(strings.TrimSpace(key))
+		}
+	}
+
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+}
+
+// httpErrorStatus the status of a request whose connection failed with err
+func httpErrorStatus(err error) int {
+	if errors.Is(err, ErrConnLimited) {
+		return http.StatusTooManyRequests
+	}
+	if errors.Is(err, ErrRejectedByRule) {
+		return http.StatusForbidden
+	}
+	if isDialTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// proxyCredentials the username and password of a `Proxy-Authorization: Basic` header
+func proxyCredentials(r *http.Request) (string, string, bool) {
+	scheme, credentials, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
+
+func (p *HttpProxyHandle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.auth != nil {
+		username, password, ok := proxyCredentials(r)
+		if !ok || !p.auth.authenticate("http proxy", r.RemoteAddr, username, password) {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="EasierConnect"`)
+			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+
+		p.auth.connOpened(username)
+		defer p.auth.connClosed(username)
+	}
+
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a proxy server, absolute URI required", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("http proxy: %s %s", r.Method, r.URL)
+
+	outReq := r.Clone(withConnMeta(r.Context(), "http", r.RemoteAddr, nil))
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+
+	resp, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		log.Printf("http proxy: %s %s failed: %s", r.Method, r.URL, err.Error())
+		http.Error(w, err.Error(), httpErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func (p *HttpProxyHandle) handleConnect(w http.ResponseWriter, r *http.Request) {
+	log.Printf("http proxy: CONNECT %s", r.Host)
+
+	rc, err := p.handle.myDialer(withConnMeta(r.Context(), "http", r.RemoteAddr, nil), "tcp", nil, r.Host)
+	if err != nil {
+		log.Printf("http proxy: CONNECT %s failed: %s", r.Host, err.Error())
+		http.Error(w, err.Error(), httpErrorStatus(err))
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		_ = rc.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c, buf, err := hijacker.Hijack()
+	if err != nil {
+		_ = rc.Close()
+		return
+	}
+
+	if _, err = c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		_ = rc.Close()
+		_ = c.Close()
+		return
+	}
+
+	// the client may have sent data right after the CONNECT request
+	if n := buf.Reader.Buffered(); n > 0 {
+		pending, _ := buf.Reader.Peek(n)
+		if _, err = rc.Write(pending); err != nil {
+			_ = rc.Close()
+			_ = c.Close()
+			return
+		}
+	}
+
+	reason := relay(c, rc, 0)
+	log.Printf("http proxy: CONNECT %s closed: %s", r.Host, reason)
+}
+
+// ServeHttpProxy listens on every address of the comma separated bindAddr, "unix:/path" for a unix socket.
+// Clients authenticate as the socks5 users when auth is set.
+func ServeHttpProxy(h *DefaultHandle, bindAddr string, auth *SocksAuth) {
+	listeners, err := listenAll("http", bindAddr, h.acl)
+	if err != nil {
+		log.Printf("HTTP proxy stopped: %s", err.Error())
+		return
+	}
+
+	s := &http.Server{
+		Handler: NewHttpProxyHandle(h, auth),
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+
+		go func(l net.Listener) {
+			defer wg.Done()
+
+			log.Printf("HTTP proxy listening on %s", l.Addr())
+
+			if err := s.Serve(l); err != nil {
+				log.Printf("HTTP proxy stopped: %s", err.Error())
+			}
+		}(l)
+	}
+
+	wg.Wait()
+}
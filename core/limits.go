@@ -0,0 +1,176 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrConnLimited = errors.New("connection limit reached")
+
+// ConnLimits caps on the proxied connections, 0 for no limit
+type ConnLimits struct {
+	MaxConns          int     // concurrent connections of all clients
+	MaxConnsPerClient int     // concurrent connections of one client ip
+	Rate              float64 // new connections per second of all clients
+	RatePerClient     float64 // new connections per second of one client ip
+}
+
+// tokenBucket allows rate events per second with bursts of up to max(rate, 1)
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(rate float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	burst := bucketBurst(rate)
+
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full whether the bucket is back to its burst, i.e. forgetting it changes nothing
+func (b *tokenBucket) full(rate float64, now time.Time) bool {
+	return rate <= 0 || b.last.IsZero() || b.tokens+now.Sub(b.last).Seconds()*rate >= bucketBurst(rate)
+}
+
+func bucketBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+type clientLimit struct {
+	active int
+	bucket tokenBucket
+}
+
+// connLimiter enforces ConnLimits, clients are told apart by ip
+type connLimiter struct {
+	lock    sync.Mutex
+	limits  ConnLimits
+	active  int
+	bucket  tokenBucket
+	clients map[string]*clientLimit
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{clients: map[string]*clientLimit{}}
+}
+
+func (l *connLimiter) setLimits(limits ConnLimits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.limits = limits
+}
+
+func (l *connLimiter) getLimits() ConnLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.limits
+}
+
+// clientKey the ip of a client address, unix socket clients share one key per socket
+func clientKey(client string) string {
+	if strings.HasPrefix(client, unixBindPrefix) {
+		return client
+	}
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		return host
+	}
+	return client
+}
+
+// acquire counts a new connection of client, ErrConnLimited if a limit is reached
+func (l *connLimiter) acquire(client string) error {
+	key := clientKey(client)
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimit{}
+	}
+
+	if l.limits.MaxConns > 0 && l.active >= l.limits.MaxConns {
+		return ErrConnLimited
+	}
+	if l.limits.MaxConnsPerClient > 0 && c.active >= l.limits.MaxConnsPerClient {
+		return ErrConnLimited
+	}
+	// the client bucket first, one client over its rate must not drain the global one
+	if !c.bucket.take(l.limits.RatePerClient, now) {
+		l.forget(key, c, now)
+		return ErrConnLimited
+	}
+	if !l.bucket.take(l.limits.Rate, now) {
+		l.forget(key, c, now)
+		return ErrConnLimited
+	}
+
+	l.active++
+	c.active++
+	l.clients[key] = c
+
+	return nil
+}
+
+func (l *connLimiter) release(client string) {
+	key := clientKey(client)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.active--
+
+	if c, ok := l.clients[key]; ok {
+		c.active--
+		l.forget(key, c, time.Now())
+	}
+
+	// clients that went idle while their bucket was refilling
+	if len(l.clients) > 1024 {
+		now := time.Now()
+		for key, c := range l.clients {
+			l.forget(key, c, now)
+		}
+	}
+}
+
+// forget drops the state of a client once it has nothing to remember, must be called with the lock held
+func (l *connLimiter) forget(key string, c *clientLimit, now time.Time) {
+	if c.active > 0 || !c.bucket.full(l.limits.RatePerClient, now) {
+		l.clients[key] = c
+		return
+	}
+	delete(l.clients, key)
+}
+
+// defaultConnLimits the limits of the server conf: maxsession for all clients and maxthread for each one
+func defaultConnLimits(maxSession, maxThread int) ConnLimits {
+	return ConnLimits{MaxConns: maxSession, MaxConnsPerClient: maxThread}
+}
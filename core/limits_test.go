@@ -0,0 +1,54 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnLimiterSubOneRatePerClient(t *testing.T) {
+	l := newConnLimiter()
+	l.setLimits(ConnLimits{RatePerClient: 0.5})
+
+	client := "192.0.2.1:40000"
+
+	if err := l.acquire(client); err != nil {
+		t.Fatalf("first connection refused: %v", err)
+	}
+	l.release(client)
+
+	// the bucket is empty until 2s have passed, neither the refusals nor the releases may reset it
+	for i := 0; i < 10; i++ {
+		if err := l.acquire(client); err != ErrConnLimited {
+			t.Fatalf("connection %d: got %v, want %v", i+2, err, ErrConnLimited)
+		}
+	}
+
+	if err := l.acquire("192.0.2.2:40000"); err != nil {
+		t.Fatalf("another client refused: %v", err)
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   float64
+		tokens float64
+		want   bool
+	}{
+		{"no rate", 0, 0, true},
+		{"sub-1 rate, partial token", 0.5, 0.9, false},
+		{"sub-1 rate, one token", 0.5, 1, true},
+		{"rate above 1, below burst", 5, 4.5, false},
+		{"rate above 1, at burst", 5, 5, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			b := tokenBucket{tokens: tt.tokens, last: now}
+			if got := b.full(tt.rate, now); got != tt.want {
+				t.Errorf("full() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const unixBindPrefix = "unix:"
+
+// ClientAcl allow and deny lists of client source addresses, checked by every listener.
+// Deny wins, an empty allow list allows everyone. Clients of unix sockets are always allowed.
+type ClientAcl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	lock   sync.Mutex
+	denied map[string]uint64 // listener -> denied attempts
+}
+
+// parseCidrs parses a comma separated list of CIDRs, a single ip is taken as a /32 (or /128)
+func parseCidrs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("invalid client address: " + item)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.New("invalid client cidr: " + item)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// NewClientAcl parses the comma separated allow and deny lists, nil if both are empty
+func NewClientAcl(allow, deny string) (*ClientAcl, error) {
+	allowNets, err := parseCidrs(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyNets, err := parseCidrs(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	if allowNets == nil && denyNets == nil {
+		return nil, nil
+	}
+
+	return &ClientAcl{allow: allowNets, deny: denyNets, denied: map[string]uint64{}}, nil
+}
+
+func containsIp(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether a client ip may connect, a nil acl allows everyone
+func (a *ClientAcl) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+
+	if containsIp(a.deny, ip) {
+		return false
+	}
+
+	return len(a.allow) == 0 || containsIp(a.allow, ip)
+}
+
+// restricted reports whether only the clients of the allow list may connect
+func (a *ClientAcl) restricted() bool {
+	return a != nil && len(a.allow) > 0
+}
+
+// Check is Allowed for the client address of a listener, denied attempts are logged and counted
+func (a *ClientAcl) Check(listener string, addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return true
+	}
+
+	if a.Allowed(ip) {
+		return true
+	}
+
+	a.lock.Lock()
+	a.denied[listener]++
+	count := a.denied[listener]
+	a.lock.Unlock()
+
+	log.Printf("%s: client %s denied by acl (%d denied so far)", listener, ip, count)
+
+	return false
+}
+
+// Denied returns the number of denied attempts per listener
+func (a *ClientAcl) Denied() map[string]uint64 {
+	denied := map[string]uint64{}
+	if a == nil {
+		return denied
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for listener, count := range a.denied {
+		denied[listener] = count
+	}
+	return denied
+}
+
+// aclListener drops the connections of denied clients before they are handed out
+type aclListener struct {
+	net.Listener
+
+	name string
+	acl  *ClientAcl
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.acl.Check(l.name, c.RemoteAddr()) {
+			return c, nil
+		}
+		_ = c.Close()
+	}
+}
+
+// splitBind returns the addresses of a comma separated bind flag
+func splitBind(bind string) []string {
+	var binds []string
+	for _, b := range strings.Split(bind, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			binds = append(binds, b)
+		}
+	}
+	return binds
+}
+
+func isUnixBind(bind string) bool {
+	return strings.HasPrefix(bind, unixBindPrefix)
+}
+
+// loopbackOnly reports whether every address of a bind flag is a loopback one or a unix socket
+func loopbackOnly(bind string) bool {
+	for _, b := range splitBind(bind) {
+		if isUnixBind(b) {
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(b)
+		if err != nil {
+			return false
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return false
+		}
+	}
+	return true
+}
+
+// firstTcpBind the first non unix socket address of a bind flag, empty if there is none
+func firstTcpBind(bind string) string {
+	for _, b := range splitBind(bind) {
+		if !isUnixBind(b) {
+			return b
+		}
+	}
+	return ""
+}
+
+// listen listens on a tcp address or on "unix:/path", the clients are filtered by acl
+func listen(name string, bind string, acl *ClientAcl) (net.Listener, error) {
+	if isUnixBind(bind) {
+		path := strings.TrimPrefix(bind, unixBindPrefix)
+
+		// a socket left behind by a previous run
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+
+		return net.Listen("unix", path)
+	}
+
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	if acl == nil {
+		return l, nil
+	}
+	return &aclListener{Listener: l, name: name, acl: acl}, nil
+}
+
+// listenAll listens on every address of a comma separated bind flag, closing them all if one fails
+func listenAll(name string, bind string, acl *ClientAcl) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	for _, b := range splitBind(bind) {
+		l, err := listen(name, b, acl)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+
+	return listeners, nil
+}
+
+// clientAddr the address of a client for logging and the connection table, unix socket clients are unnamed
+func clientAddr(c net.Conn) string {
+	if addr := c.RemoteAddr(); addr != nil && addr.String() != "" && addr.String() != "@" {
+		return addr.String()
+	}
+	return unixBindPrefix + c.LocalAddr().String()
+}
+
+// sortedListeners the keys of a Denied map in a stable order for printing
+func sortedListeners(denied map[string]uint64) []string {
+	listeners := make([]string, 0, len(denied))
+	for listener := range denied {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+	return listeners
+}
@@ -0,0 +1,321 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"EasierConnect/core/config"
+)
+
+const pacTemplate = `var domains = %s;
+var wildcards = %s;
+var dnsHosts = %s;
+var allSites = %s;
+var ranges = %s;
+// [type, value, action, min port, max port], the value of a cidr rule is [start, end]
+var localRules = %s;
+var localPolicy = %s;
+// whether names without a dns rule may be resolved to match the ip rules, not with dns leak protection
+var resolveHosts = %s;
+
+function portOf(url) {
+	var m = url.match(/^([a-z0-9+.-]+):\/\/(?:[^@\/]*@)?(?:\[[^\]]*\]|[^:\/]*)(?::(\d+))?/i);
+	if (m && m[2]) return parseInt(m[2], 10);
+	if (m && (m[1].toLowerCase() === "https" || m[1].toLowerCase() === "wss")) return 443;
+	return 80;
+}
+
+function inPorts(ports, port) {
+	return port >= ports[0] && port <= ports[1];
+}
+
+// the most specific *.suffix rule of host, like the proxy does
+function matchWildcard(host, port) {
+	var labels = host.split(".");
+	for (var i = 1; i < labels.length; i++) {
+		var suffix = labels.slice(i).join(".");
+		if (wildcards.hasOwnProperty(suffix) && dnsDomainIs(host, "." + suffix)) return inPorts(wildcards[suffix], port);
+	}
+	return false;
+}
+
+function ipToNum(ip) {
+	var p = ip.split(".");
+	return (+p[0]) * 16777216 + (+p[1]) * 65536 + (+p[2]) * 256 + (+p[3]);
+}
+
+function matchIp(ip, port) {
+	var n = ipToNum(ip);
+	for (var i = 0; i < ranges.length; i++) {
+		var r = ranges[i];
+		if (n >= r[0] && n <= r[1] && port >= r[2] && port <= r[3]) return true;
+	}
+	return false;
+}
+
+function isIp(host) {
+	return /^\d+\.\d+\.\d+\.\d+$/.test(host);
+}
+
+function matchServer(host, port) {
+	if (allSites && inPorts(allSites, port)) return true;
+	// an exact rule wins over the wildcard ones
+	if (domains.hasOwnProperty(host)) {
+		if (inPorts(domains[host], port)) return true;
+	} else if (matchWildcard(host, port)) {
+		return true;
+	}
+
+	var ip = host;
+	if (!isIp(host)) {
+		if (dnsHosts.hasOwnProperty(host)) {
+			ip = dnsHosts[host];
+		} else if (ranges.length > 0 && resolveHosts) {
+			ip = dnsResolve(host);
+		} else {
+			return false;
+		}
+	}
+
+	if (ip && domains.hasOwnProperty(ip) && inPorts(domains[ip], port)) return true;
+	if (ip && matchIp(ip, port)) return true;
+
+	return false;
+}
+
+// the action of the first matching local rule, null if none does
+function matchLocal(host, port) {
+	var ip;
+	for (var i = 0; i < localRules.length; i++) {
+		var r = localRules[i];
+		if (port < r[3] || port > r[4]) continue;
+
+		switch (r[0]) {
+		case "domain":
+			if (host === r[1]) return r[2];
+			break;
+		case "domain-suffix":
+			if (host === r[1] || dnsDomainIs(host, "." + r[1])) return r[2];
+			break;
+		case "keyword":
+			if (host.indexOf(r[1]) >= 0) return r[2];
+			break;
+		case "cidr":
+			if (ip === undefined) {
+				ip = isIp(host) ? host : (dnsHosts.hasOwnProperty(host) ? dnsHosts[host] : (resolveHosts ? dnsResolve(host) : null));
+			}
+			if (ip && ipToNum(ip) >= r[1][0] && ipToNum(ip) <= r[1][1]) return r[2];
+			break;
+		case "port":
+			return r[2];
+		}
+	}
+	return null;
+}
+
+function FindProxyForURL(url, host) {
+	var port = portOf(url);
+	// the rules are lowercase, browsers pass the host as typed
+	host = host.toLowerCase().replace(/\.$/, "");
+
+	var action = null;
+	if (localPolicy === "before") action = matchLocal(host, port);
+	if (action === null && matchServer(host, port)) action = "vpn";
+	if (action === null && localPolicy === "after") action = matchLocal(host, port);
+
+	// rejected connections are left to the proxy, a pac cannot refuse them
+	if (action === "vpn" || action === "reject") return proxy;
+	return "DIRECT";
+}
+`
+
+// PacServer serves a proxy.pac generated from the parsed rules and the local rules, it is regenerated when either change
+type PacServer struct {
+	rules      *config.Rules
+	localRules *config.LocalRules // nil when there are none
+	socksBind  string
+	httpBind   string
+
+	lock         sync.Mutex
+	version      uint64
+	localVersion uint64
+	body         string
+
+	// names are only resolved by the pac when dns leak protection is off
+	leakProtection bool
+}
+
+func NewPacServer(rules *config.Rules, localRules *config.LocalRules, socksBind, httpBind string) *PacServer {
+	return &PacServer{
+		rules:      rules,
+		localRules: localRules,
+		socksBind:  firstTcpBind(socksBind),
+		httpBind:   firstTcpBind(httpBind),
+
+		leakProtection: DnsLeakProtection,
+	}
+}
+
+// pacLocalRules the local rules in the form of the localRules variable of the pac
+func pacLocalRules(localRules *config.LocalRules) ([][]any, string) {
+	rules := [][]any{}
+	if localRules == nil {
+		return rules, ""
+	}
+
+	for _, rule := range localRules.Rules() {
+		minPort, maxPort := 0, 65535
+		if rule.Ports != nil {
+			minPort, maxPort = rule.Ports[0], rule.Ports[1]
+		}
+
+		var value any = rule.Value
+		if rule.Type == config.LocalRuleCIDR {
+			// the pac only compares ipv4 addresses
+			ip := rule.CIDR().IP.To4()
+			ones, bits := rule.CIDR().Mask.Size()
+			if ip == nil || bits != 32 {
+				continue
+			}
+			start := binary.BigEndian.Uint32(ip)
+			value = []uint32{start, start | uint32(1<<(32-ones)-1)}
+		}
+
+		rules = append(rules, []any{rule.Type, value, rule.Action, minPort, maxPort})
+	}
+
+	return rules, localRules.Policy
+}
+
+// pacHost a rule domain in the form the pac compares hosts in
+func pacHost(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func (p *PacServer) generateBody() string {
+	domains := map[string][]int{}
+	wildcards := map[string][]int{}
+	var allSites []int
+
+	p.rules.RangeDomainRules(func(domain string, ports []int) bool {
+		if domain == "*" {
+			allSites = ports
+		} else if strings.HasPrefix(domain, "*.") {
+			wildcards[pacHost(domain[2:])] = ports
+		} else if domain != "" && !strings.ContainsAny(domain, "/:") {
+			domains[pacHost(domain)] = ports
+		}
+		return true
+	})
+
+	// exceptions are not overridden by the dns rules when the proxy resolves them either
+	dnsHosts := map[string]string{}
+	p.rules.RangeDnsRules(func(domain, ip string) bool {
+		if !p.rules.IsDnsRuleException(domain) {
+			dnsHosts[pacHost(domain)] = ip
+		}
+		return true
+	})
+
+	ranges := [][]uint32{}
+	if p.rules.IsIpv4RuleAvailable() {
+		for _, rule := range *p.rules.GetIpv4Rules() {
+			start, end := rule.Range()
+			ranges = append(ranges, []uint32{start, end, uint32(rule.Ports[0]), uint32(rule.Ports[1])})
+		}
+	}
+
+	domainsJson, _ := json.Marshal(domains)
+	wildcardsJson, _ := json.Marshal(wildcards)
+	dnsHostsJson, _ := json.Marshal(dnsHosts)
+	allSitesJson, _ := json.Marshal(allSites)
+	rangesJson, _ := json.Marshal(ranges)
+
+	localRules, localPolicy := pacLocalRules(p.localRules)
+	localRulesJson, _ := json.Marshal(localRules)
+	localPolicyJson, _ := json.Marshal(localPolicy)
+	resolveHostsJson, _ := json.Marshal(!p.leakProtection)
+
+	log.Printf("pac: generated with %v domains, %v wildcard domains, %v dns rules, %v ipv4 ranges, %v local rules",
+		len(domains), len(wildcards), len(dnsHosts), len(ranges), len(localRules))
+
+	return fmt.Sprintf(pacTemplate, domainsJson, wildcardsJson, dnsHostsJson, allSitesJson, rangesJson, localRulesJson, localPolicyJson, resolveHostsJson)
+}
+
+// proxyAddr picks the address clients should use to reach a listener, falling back to the host the pac was requested from
+func proxyAddr(bind string, requestHost string) string {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return bind
+	}
+
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+		if h, _, err := net.SplitHostPort(requestHost); err == nil {
+			host = h
+		} else if requestHost != "" {
+			host = requestHost
+		}
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// Generate returns the pac script, requestHost is used when a listener is bound to all interfaces
+func (p *PacServer) Generate(requestHost string) string {
+	p.lock.Lock()
+	var localVersion uint64
+	if p.localRules != nil {
+		localVersion = p.localRules.Version()
+	}
+	if p.body == "" || p.version != p.rules.Version() || p.localVersion != localVersion {
+		p.version = p.rules.Version()
+		p.localVersion = localVersion
+		p.body = p.generateBody()
+	}
+	body := p.body
+	p.lock.Unlock()
+
+	var proxies []string
+	if p.socksBind != "" {
+		addr := proxyAddr(p.socksBind, requestHost)
+		proxies = append(proxies, "SOCKS5 "+addr, "SOCKS "+addr)
+	}
+	if p.httpBind != "" {
+		proxies = append(proxies, "PROXY "+proxyAddr(p.httpBind, requestHost))
+	}
+
+	return fmt.Sprintf("var proxy = %q;\n", strings.Join(proxies, "; ")) + body
+}
+
+func (p *PacServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/proxy.pac" && r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = io.WriteString(w, p.Generate(r.Host))
+}
+
+func ServePac(rules *config.Rules, localRules *config.LocalRules, bindAddr string, socksBind string, httpBind string, acl *ClientAcl) {
+	l, err := listen("pac", bindAddr, acl)
+	if err != nil {
+		log.Printf("PAC server stopped: %s", err.Error())
+		return
+	}
+
+	log.Printf("PAC server listening on http://%s/proxy.pac", bindAddr)
+
+	if err := http.Serve(l, NewPacServer(rules, localRules, socksBind, httpBind)); err != nil {
+		log.Printf("PAC server stopped: %s", err.Error())
+	}
+}
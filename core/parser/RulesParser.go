@@ -2,11 +2,8 @@ package parser
 
 import (
 	"EasierConnect/core/config"
-	"fmt"
 	"github.com/dlclark/regexp2"
 	"log"
-	"math"
-	"net"
 	"net/url"
 	"regexp"
 	"runtime"
@@ -16,74 +13,7 @@ import (
 
 var domainRegExp *regexp.Regexp
 
-func StringArrToIntArr(strArr []string) [4]int {
-	var intArr [4]int
-
-	for index, str := range strArr {
-		intArr[index], _ = strconv.Atoi(str)
-	}
-
-	return intArr
-}
-
-func getMaskByIpRange(fromIp string, toIp string) (ones int, bits int) {
-	fromIpSplit := StringArrToIntArr(strings.Split(fromIp, "."))
-	toIpSplit := StringArrToIntArr(strings.Split(toIp, "."))
-
-	fromIpSplit[3] = int(math.Max(float64(fromIpSplit[3]-1), 0))
-	toIpSplit[3] = int(math.Min(float64(toIpSplit[3]+1), 255))
-
-	var mask [4]byte
-	for i := 3; i >= 0; i-- {
-		mask[i] = uint8(255 - toIpSplit[i] + fromIpSplit[i])
-	}
-
-	return net.IPv4Mask(mask[0], mask[1], mask[2], mask[3]).Size()
-}
-
-// from https://github.com/dromara/hutool/blob/fc091b01a23271e02f3174c45942105048155c90/hutool-core/src/main/java/cn/hutool/core/net/Ipv4Util.java#L114
-func getIPsInRange(from, to string) *[]string {
-	ipf := StringArrToIntArr(strings.Split(from, "."))
-	ipt := StringArrToIntArr(strings.Split(to, "."))
-
-	ips := make([]string, 4096)
-
-	equ := func(condition bool, yes int, no int) int {
-		if condition {
-			return yes
-		} else {
-			return no
-		}
-	}
-
-	var a, b, c int
-
-	for a = ipf[0]; a <= ipt[0]; a++ {
-		for b = equ(a == ipf[0], ipf[1], 0); b <= equ(a == ipt[0], ipt[1], 255); b++ {
-			for c = equ(b == ipf[1], ipf[2], 0); c <= equ(b == ipt[1], ipt[2], 255); c++ {
-				for d := equ(c == ipf[2], ipf[3], 0); d <= equ(c == ipt[2], ipt[3], 255); d++ {
-					ips = append(ips, strconv.Itoa(a)+"."+strconv.Itoa(b)+"."+strconv.Itoa(c)+"."+strconv.Itoa(d))
-				}
-			}
-		}
-	}
-
-	return &ips
-}
-
-func countByIpRange(from string, to string) int {
-	count := 1
-	ipf := StringArrToIntArr(strings.Split(from, "."))
-	ipt := StringArrToIntArr(strings.Split(to, "."))
-
-	for i := 3; i >= 0; i-- {
-		count += (ipt[i] - ipf[i]) * int(math.Pow(256, float64(3-i)))
-	}
-
-	return count
-}
-
-func processSingleIpRule(rule, port string, debug bool, waitChan *chan int) {
+func processSingleIpRule(rules *config.Rules, rule, port string, debug bool, waitChan *chan int) {
 	appendRule := func(value *string, isIPV4RangeRule bool, isCIDR bool) {
 		minValue := port
 		maxValue := port
@@ -110,46 +40,30 @@ func processSingleIpRule(rule, port string, debug bool, waitChan *chan int) {
 		}
 
 		if isIPV4RangeRule {
-			config.AppendSingleIpv4RangeRule(*value, []int{minValueInt, maxValueInt}, isCIDR, debug)
+			rules.AppendSingleIpv4RangeRule(*value, []int{minValueInt, maxValueInt}, isCIDR, debug)
 		} else {
-			config.AppendSingleDomainRule(*value, []int{minValueInt, maxValueInt}, debug)
+			rules.AppendSingleDomainRule(*value, []int{minValueInt, maxValueInt}, debug)
 		}
 	}
 
 	if strings.Contains(rule, "~") { // ip range 1.1.1.7~1.1.7.9
-		from := strings.Split(rule, "~")[0]
-		to := strings.Split(rule, "~")[1]
-		size := countByIpRange(from, to)
+		from, to, err := config.ParseIpv4Range(rule)
+		if err != nil {
+			log.Printf("Cannot parse ip range %s: %s", rule, err.Error())
+			*waitChan <- 1
+			return
+		}
 
-		mask, k := getMaskByIpRange(from, to)
+		// split into the minimal list of cidr blocks covering exactly the range
+		cidrs := config.Ipv4RangeToCIDRs(from, to)
 
 		if debug {
-			log.Printf("Handling rule for: %s-%s mask: %v", from, to, mask)
+			log.Printf("Handling rule for: %s -> %v", rule, cidrs)
 		}
 
-		// mask == 0 -> cannot cover to cidr
-		if mask != 0 && mask <= 28 {
-			if debug {
-				log.Printf("using Cidr %s-%s mask: %v %v", from, to, mask, k)
-			}
-
-			cidr := fmt.Sprintf("%s/%v", from, mask)
-
-			appendRule(&cidr, true, true)
-		} else {
-			if size > 4096 {
-				log.Printf("Super large rule detected for: %s-%s mask: %v", from, to, mask)
-
-				appendRule(&rule, true, false)
-			} else {
-				if size > 1024 {
-					log.Printf("Large rule detected for: %s-%s mask: %v", from, to, mask)
-				}
-
-				for _, domain := range *getIPsInRange(from, to) {
-					appendRule(&domain, false, false)
-				}
-			}
+		for _, cidr := range cidrs {
+			cidrString := cidr.String()
+			appendRule(&cidrString, true, true)
 		}
 	} else { // http://domain.example.com/path/to&something=good#extra
 		appendRule(&rule, false, false)
@@ -166,7 +80,7 @@ func processSingleIpRule(rule, port string, debug bool, waitChan *chan int) {
 	*waitChan <- 1
 }
 
-func processDnsData(dnsData string, debug bool) {
+func processDnsData(rules *config.Rules, dnsData string, debug bool) {
 	for _, ent := range strings.Split(dnsData, ";") {
 		dnsEntry := strings.Split(ent, ":")
 
@@ -180,13 +94,13 @@ func processDnsData(dnsData string, debug bool) {
 			}
 
 			if domain != "" && ip != "" {
-				config.AppendSingleDnsRule(domain, ip, debug)
+				rules.AppendSingleDnsRule(domain, ip, debug)
 			}
 		}
 	}
 }
 
-func processRcsData(rcsData config.Resource, debug bool, waitChan *chan int, cpuNumber *int) {
+func processRcsData(rules *config.Rules, rcsData config.Resource, debug bool, waitChan *chan int, cpuNumber *int) {
 	RcsLen := len(rcsData.Rcs.Rc)
 	for RcsIndex, ent := range rcsData.Rcs.Rc {
 		if debug {
@@ -210,7 +124,7 @@ func processRcsData(rcsData config.Resource, debug bool, waitChan *chan int, cpu
 				} else {
 					<-*waitChan
 				}
-				processSingleIpRule(domain, portRange, debug, waitChan)
+				processSingleIpRule(rules, domain, portRange, debug, waitChan)
 			}
 		}
 
@@ -218,7 +132,10 @@ func processRcsData(rcsData config.Resource, debug bool, waitChan *chan int, cpu
 	}
 }
 
-func ParseResourceLists(host, twfID string, debug bool) {
+func ParseResourceLists(rules *config.Rules, host, twfID string, debug bool) {
+	// compiled once parsed, the first lookups do not pay for it
+	defer rules.Compile()
+
 	ResourceList := config.Resource{}
 	res, ok := ParseXml(&ResourceList, host, config.PathRlist, twfID)
 
@@ -264,33 +181,33 @@ func ParseResourceLists(host, twfID string, debug bool) {
 				ResourceList.Rcs.Rc = append(ResourceList.Rcs.Rc, entry)
 			}
 
-			processRcsData(ResourceList, debug, &waitChan, &cpuNumber)
+			processRcsData(rules, ResourceList, debug, &waitChan, &cpuNumber)
 
-			log.Printf("Parsed %v Domain rules", config.GetDomainRuleLen())
-			log.Printf("Parsed %v Ipv4 rules", config.GetIpv4RuleLen())
+			log.Printf("Parsed %v Domain rules", rules.GetDomainRuleLen())
+			log.Printf("Parsed %v Ipv4 rules", rules.GetIpv4RuleLen())
 
 			DnsDataRegexp := regexp2.MustCompile("(?<=<Dns dnsserver=\"\" data=\")[0-9A-Za-z:;.-]*?(?=\")", 0)
 			DnsDataRegexpMatches, _ := DnsDataRegexp.FindStringMatch(resUrlDecodedValue)
 
-			processDnsData(DnsDataRegexpMatches.String(), debug)
+			processDnsData(rules, DnsDataRegexpMatches.String(), debug)
 
-			log.Printf("Parsed %v Dns rules", config.GetDnsRuleLen())
+			log.Printf("Parsed %v Dns rules", rules.GetDnsRuleLen())
 		}
 	} else {
 		log.Printf("try parsing ResourceLists by goXml")
 
-		processRcsData(ResourceList, debug, &waitChan, &cpuNumber)
+		processRcsData(rules, ResourceList, debug, &waitChan, &cpuNumber)
 
-		log.Printf("Parsed %v Domain rules", config.GetDomainRuleLen())
-		log.Printf("Parsed %v Ipv4 rules", config.GetIpv4RuleLen())
+		log.Printf("Parsed %v Domain rules", rules.GetDomainRuleLen())
+		log.Printf("Parsed %v Ipv4 rules", rules.GetIpv4RuleLen())
 
-		processDnsData(ResourceList.Dns.Data, debug)
+		processDnsData(rules, ResourceList.Dns.Data, debug)
 
-		log.Printf("Parsed %v Dns rules", config.GetDnsRuleLen())
+		log.Printf("Parsed %v Dns rules", rules.GetDnsRuleLen())
 	}
 }
 
-func ParseConfLists(host, twfID string, debug bool) {
+func ParseConfLists(rules *config.Rules, host, twfID string, debug bool) {
 	conf := config.Conf{}
 	result, ok := ParseXml(&conf, host, config.PathConf, twfID)
 
@@ -309,7 +226,7 @@ func ParseConfLists(host, twfID string, debug bool) {
 
 			dns1 = iptunDnsRegexpMatches.String()
 
-			config.AppendDnsServer(strings.TrimSpace(dns1))
+			rules.AppendDnsServer(strings.TrimSpace(dns1))
 
 			iptunDnsbakRegexp := regexp2.MustCompile("(?<=iptunDnsBak=\")[0-9A-Za-z:.-]*?(?=\")", 0)
 			iptunDnsbakRegexpMatches, err := iptunDnsbakRegexp.FindStringMatch(result)
@@ -321,16 +238,64 @@ func ParseConfLists(host, twfID string, debug bool) {
 
 			dns2 = iptunDnsbakRegexpMatches.String()
 
-			config.AppendDnsServer(strings.TrimSpace(dns2))
+			rules.AppendDnsServer(strings.TrimSpace(dns2))
 
 			log.Printf("Server dns server (parsed by regExp): [%s] [%s]", dns1, dns2)
+
+			var exceptions []string
+			exceptionRegexp := regexp2.MustCompile("(?<=<Exception>)[^<]*?(?=</Exception>)", 0)
+			exceptionMatch, err := exceptionRegexp.FindStringMatch(result)
+			for err == nil && exceptionMatch != nil {
+				exceptions = append(exceptions, exceptionMatch.String())
+				exceptionMatch, err = exceptionRegexp.FindNextMatch(exceptionMatch)
+			}
+
+			rules.AppendDnsRuleException(exceptions...)
+
+			log.Printf("Dns rule exceptions (parsed by regExp): %v", exceptions)
+
+			var maxSession, maxThread string
+			if match, err := regexp2.MustCompile("(?<=<TcpApplication[^>]*maxsession=\")[0-9]*?(?=\")", 0).FindStringMatch(result); err == nil && match != nil {
+				maxSession = match.String()
+			}
+			if match, err := regexp2.MustCompile("(?<=<TcpApplication[^>]*maxthread=\")[0-9]*?(?=\")", 0).FindStringMatch(result); err == nil && match != nil {
+				maxThread = match.String()
+			}
+
+			rules.SetTcpApplicationLimits(maxSession, maxThread)
+
+			log.Printf("TcpApplication maxsession: [%s], maxthread: [%s] (parsed by regExp)", maxSession, maxThread)
+
+			var autoruleEnable, autoruleLimit string
+			if match, err := regexp2.MustCompile("(?<=<Autorule[^>]*enable=\")[0-9]*?(?=\")", 0).FindStringMatch(result); err == nil && match != nil {
+				autoruleEnable = match.String()
+			}
+			if match, err := regexp2.MustCompile("(?<=<Autorule[^>]*rule_limit=\")[0-9]*?(?=\")", 0).FindStringMatch(result); err == nil && match != nil {
+				autoruleLimit = match.String()
+			}
+
+			rules.SetAutorule(autoruleEnable, autoruleLimit)
+
+			log.Printf("Autorule enable: [%s], rule_limit: [%s] (parsed by regExp)", autoruleEnable, autoruleLimit)
 		}
 	} else {
 		dns1 := conf.L3VPN.IptunDns
 		dns2 := conf.L3VPN.IptunDnsBak
 
-		config.AppendDnsServer(dns1, dns2)
+		rules.AppendDnsServer(dns1, dns2)
 
 		log.Printf("Server dns server (parsed by goXml): [%s] [%s]", dns1, dns2)
+
+		rules.AppendDnsRuleException(conf.DnsRuleExceptions.Exception...)
+
+		log.Printf("Dns rule exceptions (parsed by goXml): %v", conf.DnsRuleExceptions.Exception)
+
+		rules.SetTcpApplicationLimits(conf.TcpApplication.Maxsession, conf.TcpApplication.Maxthread)
+
+		log.Printf("TcpApplication maxsession: [%s], maxthread: [%s] (parsed by goXml)", conf.TcpApplication.Maxsession, conf.TcpApplication.Maxthread)
+
+		rules.SetAutorule(conf.Autorule.Enable, conf.Autorule.RuleLimit)
+
+		log.Printf("Autorule enable: [%s], rule_limit: [%s] (parsed by goXml)", conf.Autorule.Enable, conf.Autorule.RuleLimit)
 	}
 }
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var errIdleTimeout = errors.New("idle timeout")
+
+// closeWriter implemented by net.TCPConn and gonet.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// writeError an error of the destination side of copyHalf
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return e.err.Error()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half-close not supported")
+}
+
+// copyHalf copies src to dst until src reaches EOF. With an idle timeout, the copy ends once
+// neither direction moved data for that long, lastActivity is shared by both directions.
+func copyHalf(dst, src net.Conn, idleTimeout time.Duration, lastActivity *int64) error {
+	buf := make([]byte, 32*1024)
+	var deadline time.Time
+
+	for {
+		if idleTimeout > 0 {
+			// setting a deadline is not free, only push it forward once a second at most
+			if now := time.Now(); deadline.Sub(now) < idleTimeout-time.Second {
+				deadline = now.Add(idleTimeout)
+				if err := src.SetReadDeadline(deadline); err != nil {
+					return err
+				}
+			}
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(lastActivity, time.Now().UnixNano())
+
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return &writeError{werr}
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			if isTimeout(err) {
+				// the other direction may still be busy
+				if time.Since(time.Unix(0, atomic.LoadInt64(lastActivity))) < idleTimeout {
+					deadline = time.Time{}
+					continue
+				}
+				return errIdleTimeout
+			}
+			return err
+		}
+	}
+}
+
+// isTimeout the netstack conns report deadlines with their own error, not os.ErrDeadlineExceeded
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// watchClient returns a context cancelled when the client goes away while its target is being dialed.
+// stop ends the watch and returns what the client sent meanwhile, it belongs to the target.
+func watchClient(ctx context.Context, c net.Conn) (context.Context, func() []byte) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	done := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		n, err := c.Read(buf)
+		if err != nil && !isTimeout(err) {
+			cancel()
+		}
+		done <- buf[:n]
+	}()
+
+	return ctx, func() []byte {
+		// unblock the read, the relay sets its own deadlines
+		_ = c.SetReadDeadline(time.Unix(1, 0))
+		early := <-done
+		_ = c.SetReadDeadline(time.Time{})
+
+		cancel()
+		return early
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		if cw.CloseWrite() == nil {
+			return
+		}
+	}
+
+	// no half-close, the peer only learns about the end when the connection is closed
+	_ = conn.Close()
+}
+
+type halfResult struct {
+	upload bool
+	err    error
+}
+
+// relay copies between client and remote in both directions until both are finished.
+// EOF on one side is propagated as a half-close to the other, any error closes both.
+// It returns why the connection ended.
+func relay(client, remote net.Conn, idleTimeout time.Duration) string {
+	lastActivity := time.Now().UnixNano()
+
+	// deadlines of the negotiation
+	_ = client.SetDeadline(time.Time{})
+
+	results := make(chan halfResult, 2)
+
+	go func() {
+		err := copyHalf(remote, client, idleTimeout, &lastActivity)
+		if err == nil {
+			closeWrite(remote)
+		}
+		results <- halfResult{upload: true, err: err}
+	}()
+
+	go func() {
+		err := copyHalf(client, remote, idleTimeout, &lastActivity)
+		if err == nil {
+			closeWrite(client)
+		}
+		results <- halfResult{upload: false, err: err}
+	}()
+
+	reason := ""
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if result.err == nil || reason != "" {
+			continue
+		}
+
+		reason = describeRelayError(result)
+
+		// unblock the other direction
+		closeRelay(client, remote, reason)
+	}
+
+	if reason == "" {
+		reason = "closed"
+	}
+	closeRelay(client, remote, reason)
+
+	return reason
+}
+
+func closeRelay(client, remote net.Conn, reason string) {
+	if tracked, ok := remote.(*trackedConn); ok {
+		tracked.setCloseReason(reason)
+	}
+
+	_ = client.Close()
+	_ = remote.Close()
+}
+
+func describeRelayError(result halfResult) string {
+	if result.err == errIdleTimeout {
+		return errIdleTimeout.Error()
+	}
+
+	// the upload reads the client and writes the remote, the download the other way round
+	var we *writeError
+	onRemote := errors.As(result.err, &we) == result.upload
+
+	if onRemote {
+		return "remote error: " + result.err.Error()
+	}
+	return "client error: " + result.err.Error()
+}
@@ -0,0 +1,608 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsTimeout = 5 * time.Second
+
+const (
+	UpstreamTunnelUdp = "tunnel-udp"
+	UpstreamTunnelTcp = "tunnel-tcp"
+	UpstreamUdp       = "udp"
+	UpstreamDot       = "tls"
+	UpstreamDoh       = "https"
+)
+
+const (
+	// try the upstreams one after another
+	StrategyFallback = "fallback"
+	// query all the upstreams at once, the first answer wins
+	StrategyRace = "race"
+)
+
+// an upstream failing this many times in a row is skipped for a while, unless no other upstream is left
+const upstreamMaxFailures = 3
+const upstreamDownTime = 30 * time.Second
+
+var ErrDnsLeakBlocked = errors.New("intranet name not resolved by the tunnel dns, public dns blocked by leak protection")
+
+var errNoTunnelDns = errors.New("no intranet dns server available")
+
+// exchange sends a raw dns message over conn and reads the reply, tcp messages are length prefixed
+func exchange(conn net.Conn, query []byte, timeout time.Duration) ([]byte, error) {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	_, isUdp := conn.(net.PacketConn)
+
+	if isUdp {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	if err := writeStreamMessage(conn, query); err != nil {
+		return nil, err
+	}
+
+	return readStreamMessage(conn)
+}
+
+func readStreamMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeStreamMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func isTruncated(reply []byte) bool {
+	var p dnsmessage.Parser
+	header, err := p.Start(reply)
+	return err == nil && header.Truncated
+}
+
+// exchangeWith tries udp first and falls back to tcp when the reply is truncated
+func exchangeWith(dial func(network string) (net.Conn, error), query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := dial("udp")
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := exchange(conn, query, timeout)
+	if err == nil && !isTruncated(reply) {
+		return reply, nil
+	}
+
+	conn, err = dial("tcp")
+	if err != nil {
+		return nil, err
+	}
+	return exchange(conn, query, timeout)
+}
+
+// ResolverUpstream a dns server of the resolver chain, written as `type://address[?timeout=2s]`:
+//
+//	tunnel-udp://10.0.0.53, tunnel-tcp://10.0.0.53:53 (through the vpn, without address: the dns servers of the server config)
+//	udp://223.5.5.5:53 (or just 223.5.5.5:53), tls://dns.alidns.com:853, https://dns.alidns.com/dns-query
+type ResolverUpstream struct {
+	Type    string
+	Address string
+	Timeout time.Duration
+
+	lock      sync.Mutex
+	failures  int // in a row
+	downUntil time.Time
+	rtt       time.Duration // moving average of the successful queries
+	total     uint64
+	failed    uint64
+
+	httpClient *http.Client
+}
+
+func ParseResolverUpstream(spec string) (*ResolverUpstream, error) {
+	spec = strings.TrimSpace(spec)
+	if !strings.Contains(spec, "://") {
+		spec = UpstreamUdp + "://" + spec
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := &ResolverUpstream{Type: u.Scheme, Address: u.Host, Timeout: dnsTimeout}
+
+	if timeout := u.Query().Get("timeout"); timeout != "" {
+		upstream.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	withPort := func(port string) {
+		if _, _, err := net.SplitHostPort(upstream.Address); err != nil {
+			upstream.Address = net.JoinHostPort(upstream.Address, port)
+		}
+	}
+
+	switch upstream.Type {
+	case UpstreamTunnelUdp, UpstreamTunnelTcp:
+		if upstream.Address != "" {
+			host, _, err := net.SplitHostPort(upstream.Address)
+			if err != nil {
+				host = upstream.Address
+			}
+			if net.ParseIP(host).To4() == nil {
+				return nil, errors.New("tunnel dns upstream must be an ipv4 address: " + spec)
+			}
+			upstream.Address = host
+		}
+	case UpstreamUdp:
+		if upstream.Address == "" {
+			return nil, errors.New("missing address: " + spec)
+		}
+		withPort("53")
+	case UpstreamDot:
+		if upstream.Address == "" {
+			return nil, errors.New("missing address: " + spec)
+		}
+		withPort("853")
+	case UpstreamDoh:
+		if upstream.Address == "" {
+			return nil, errors.New("missing address: " + spec)
+		}
+		u.RawQuery = ""
+		upstream.Address = u.String()
+		upstream.httpClient = &http.Client{Timeout: upstream.Timeout}
+	default:
+		return nil, errors.New("unknown dns upstream type: " + spec)
+	}
+
+	return upstream, nil
+}
+
+// ParseResolverUpstreams parses a comma separated list of upstreams
+func ParseResolverUpstreams(specs string) ([]*ResolverUpstream, error) {
+	var upstreams []*ResolverUpstream
+	for _, spec := range strings.Split(specs, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+
+		upstream, err := ParseResolverUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	return upstreams, nil
+}
+
+// DefaultResolverUpstreams the intranet dns servers through the tunnel, then the public upstream if any.
+// The local dns server splits the names between them instead, see ExchangeSplit.
+func DefaultResolverUpstreams(publicUpstream string) []*ResolverUpstream {
+	upstreams := []*ResolverUpstream{{Type: UpstreamTunnelUdp, Timeout: dnsTimeout}}
+
+	if publicUpstream != "" {
+		upstream, err := ParseResolverUpstream(publicUpstream)
+		if err != nil {
+			log.Printf("Ignoring invalid public dns upstream: %s", err.Error())
+		} else {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+
+	return upstreams
+}
+
+func (u *ResolverUpstream) String() string {
+	if u.Address == "" {
+		return u.Type + "://"
+	}
+	if u.Type == UpstreamDoh {
+		return u.Address
+	}
+	return u.Type + "://" + u.Address
+}
+
+func (u *ResolverUpstream) isTunnel() bool {
+	return u.Type == UpstreamTunnelUdp || u.Type == UpstreamTunnelTcp
+}
+
+func (u *ResolverUpstream) healthy() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return time.Now().After(u.downUntil)
+}
+
+func (u *ResolverUpstream) report(rtt time.Duration, err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.total++
+
+	if err != nil {
+		u.failed++
+		u.failures++
+		if u.failures == upstreamMaxFailures {
+			log.Printf("dns upstream %s is down after %v failures: %s", u, u.failures, err.Error())
+		}
+		if u.failures >= upstreamMaxFailures {
+			u.downUntil = time.Now().Add(upstreamDownTime)
+		}
+		return
+	}
+
+	if u.failures >= upstreamMaxFailures {
+		log.Printf("dns upstream %s is up again", u)
+	}
+	u.failures = 0
+	u.downUntil = time.Time{}
+
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = (u.rtt*7 + rtt) / 8
+	}
+}
+
+func (u *ResolverUpstream) exchangeDoh(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, u.Address, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server returned %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (u *ResolverUpstream) exchangeTunnel(h *DefaultHandle, query []byte) ([]byte, error) {
+	servers := []string{u.Address}
+	if u.Address == "" {
+		servers = h.rules.GetDnsServer()
+	}
+
+	err := errNoTunnelDns
+
+	for _, server := range servers {
+		if server == "" || server == "0.0.0.0" {
+			continue
+		}
+
+		dial := func(network string) (net.Conn, error) {
+			return h.dialTunnelDns(network, server)
+		}
+
+		var reply []byte
+		if u.Type == UpstreamTunnelTcp {
+			var conn net.Conn
+			if conn, err = dial("tcp"); err == nil {
+				reply, err = exchange(conn, query, u.Timeout)
+			}
+		} else {
+			reply, err = exchangeWith(dial, query, u.Timeout)
+		}
+
+		if err == nil {
+			return reply, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Exchange sends a raw dns query to the upstream
+func (u *ResolverUpstream) Exchange(h *DefaultHandle, query []byte) ([]byte, error) {
+	switch u.Type {
+	case UpstreamTunnelUdp, UpstreamTunnelTcp:
+		return u.exchangeTunnel(h, query)
+	case UpstreamUdp:
+		return exchangeWith(func(network string) (net.Conn, error) {
+			return net.DialTimeout(network, u.Address, u.Timeout)
+		}, query, u.Timeout)
+	case UpstreamDot:
+		host, _, _ := net.SplitHostPort(u.Address)
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: u.Timeout}, "tcp", u.Address, &tls.Config{ServerName: host})
+		if err != nil {
+			return nil, err
+		}
+		return exchange(conn, query, u.Timeout)
+	case UpstreamDoh:
+		return u.exchangeDoh(query)
+	}
+
+	return nil, errors.New("unknown dns upstream type: " + u.Type)
+}
+
+// ResolverChain ordered dns upstreams shared by the socks resolver and the local dns server.
+// Intranet names only go to the tunnel upstreams when leak protection is on, dns rule exceptions never do.
+type ResolverChain struct {
+	handle    *DefaultHandle
+	upstreams []*ResolverUpstream
+	strategy  string
+
+	// the default upstreams, ExchangeSplit sends intranet names to the tunnel ones and the others to the public ones
+	split bool
+}
+
+// NewResolverChain an empty strategy is StrategyFallback
+func NewResolverChain(h *DefaultHandle, upstreams []*ResolverUpstream, strategy string) (*ResolverChain, error) {
+	if strategy == "" {
+		strategy = StrategyFallback
+	}
+	if strategy != StrategyFallback && strategy != StrategyRace {
+		return nil, errors.New("unknown dns strategy: " + strategy)
+	}
+
+	return &ResolverChain{handle: h, upstreams: upstreams, strategy: strategy}, nil
+}
+
+func (c *ResolverChain) hasPublicUpstream() bool {
+	for _, u := range c.upstreams {
+		if !u.isTunnel() {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates the upstreams allowed to resolve name, healthy ones first.
+// With split, intranet names only go to the tunnel upstreams and the others to the public ones (if there are any).
+func (c *ResolverChain) candidates(name string, qtype dnsmessage.Type, split bool) ([]*ResolverUpstream, bool) {
+	exception := c.handle.rules.IsDnsRuleException(name)
+
+	intranetName := name
+	if qtype == dnsmessage.TypePTR {
+		if ip := reverseName(name); ip != "" {
+			intranetName = ip
+		}
+	}
+	intranet := c.handle.isIntranetName(intranetName)
+	intranetOnly := c.handle.leakProtection && intranet
+
+	skipTunnel := exception || (split && !intranet && c.hasPublicUpstream())
+	skipPublic := intranetOnly || (split && intranet)
+
+	var healthy, down []*ResolverUpstream
+	for _, u := range c.upstreams {
+		if (skipTunnel && u.isTunnel()) || (skipPublic && !u.isTunnel()) {
+			continue
+		}
+
+		if u.healthy() {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+
+	return append(healthy, down...), intranetOnly
+}
+
+type upstreamResult struct {
+	upstream *ResolverUpstream
+	reply    []byte
+	err      error
+}
+
+func (c *ResolverChain) query(u *ResolverUpstream, query []byte) upstreamResult {
+	startTime := time.Now()
+	reply, err := u.Exchange(c.handle, query)
+
+	if err == nil {
+		var p dnsmessage.Parser
+		var header dnsmessage.Header
+		if header, err = p.Start(reply); err == nil && header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+			err = errors.New("dns server returned " + header.RCode.String())
+		}
+	}
+
+	// the server config has no dns, that is not the upstream's fault
+	if err != errNoTunnelDns {
+		u.report(time.Since(startTime), err)
+	}
+
+	return upstreamResult{upstream: u, reply: reply, err: err}
+}
+
+func isNameError(reply []byte) bool {
+	var p dnsmessage.Parser
+	header, err := p.Start(reply)
+	return err == nil && header.RCode == dnsmessage.RCodeNameError
+}
+
+// Exchange resolves a raw dns query through the chain.
+// A name error does not stop the chain: intranet servers often only know their own zones.
+func (c *ResolverChain) Exchange(query []byte) ([]byte, error) {
+	return c.exchange(query, false)
+}
+
+// ExchangeSplit is Exchange for the clients of the local dns server: with the default upstreams,
+// intranet names only go through the tunnel and everything else only to the public upstream.
+func (c *ResolverChain) ExchangeSplit(query []byte) ([]byte, error) {
+	return c.exchange(query, c.split)
+}
+
+func (c *ResolverChain) exchange(query []byte, split bool) ([]byte, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+
+	upstreams, intranetOnly := c.candidates(name, q.Type, split)
+	if len(upstreams) == 0 {
+		if intranetOnly {
+			return nil, ErrDnsLeakBlocked
+		}
+		return nil, errors.New("no dns upstream available for " + name)
+	}
+
+	results := make(chan upstreamResult, len(upstreams))
+	if c.strategy == StrategyRace {
+		for _, u := range upstreams {
+			go func(u *ResolverUpstream) {
+				results <- c.query(u, query)
+			}(u)
+		}
+	}
+
+	var nameError []byte
+	err = nil
+	for _, u := range upstreams {
+		var result upstreamResult
+		if c.strategy == StrategyRace {
+			result = <-results
+		} else {
+			result = c.query(u, query)
+		}
+
+		if result.err != nil {
+			err = result.err
+			if DebugDump {
+				log.Printf("dns: %s %s failed on %s: %s", q.Type, name, result.upstream, result.err.Error())
+			}
+			continue
+		}
+
+		if isNameError(result.reply) {
+			if nameError == nil {
+				nameError = result.reply
+			}
+			continue
+		}
+
+		if DebugDump {
+			log.Printf("dns: %s %s answered by %s", q.Type, name, result.upstream)
+		}
+		return result.reply, nil
+	}
+
+	if nameError != nil {
+		return nameError, nil
+	}
+
+	if intranetOnly {
+		return nil, fmt.Errorf("%w: %s", ErrDnsLeakBlocked, err.Error())
+	}
+	return nil, err
+}
+
+// dialPipe a connection answered by the chain, lets net.Resolver use it
+func (c *ResolverChain) dialPipe() net.Conn {
+	client, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+
+		for {
+			query, err := readStreamMessage(server)
+			if err != nil {
+				return
+			}
+
+			reply, err := c.Exchange(query)
+			if err != nil {
+				return
+			}
+
+			if err = writeStreamMessage(server, reply); err != nil {
+				return
+			}
+		}
+	}()
+
+	return client
+}
+
+// NetResolver a net.Resolver resolving through the chain
+func (c *ResolverChain) NetResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return c.dialPipe(), nil
+		},
+	}
+}
+
+// ResolverUpstreamStats health of an upstream, for display
+type ResolverUpstreamStats struct {
+	Upstream string
+	Healthy  bool
+	Rtt      time.Duration
+	Total    uint64
+	Failed   uint64
+}
+
+func (c *ResolverChain) Stats() []ResolverUpstreamStats {
+	var stats []ResolverUpstreamStats
+	for _, u := range c.upstreams {
+		u.lock.Lock()
+		stats = append(stats, ResolverUpstreamStats{
+			Upstream: u.String(),
+			Healthy:  time.Now().After(u.downUntil),
+			Rtt:      u.rtt,
+			Total:    u.total,
+			Failed:   u.failed,
+		})
+		u.lock.Unlock()
+	}
+	return stats
+}
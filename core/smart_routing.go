@@ -0,0 +1,296 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"EasierConnect/core/config"
+)
+
+// max learned rules when the server conf does not set Autorule rule_limit
+const defaultLearnedRulesLimit = 1000
+
+// LearnedRule a route that worked for a host after the one chosen by the rules failed
+type LearnedRule struct {
+	Host    string             `json:"host"`
+	Action  config.RouteAction `json:"action"`
+	Expires time.Time          `json:"expires"`
+}
+
+// LearnedRules the routes learned by the smart routing, saved to a json file so they survive restarts
+type LearnedRules struct {
+	lock  sync.Mutex
+	file  string // empty to keep them in memory only
+	ttl   time.Duration
+	limit int
+	rules map[string]*LearnedRule
+
+	// rules dropped without being saved yet, written by the next save
+	dirty bool
+}
+
+// LoadLearnedRules reads the learned rules of file, a missing file is an empty cache
+func LoadLearnedRules(file string, ttl time.Duration, limit int) (*LearnedRules, error) {
+	if limit <= 0 {
+		limit = defaultLearnedRulesLimit
+	}
+
+	l := &LearnedRules{file: file, ttl: ttl, limit: limit, rules: map[string]*LearnedRule{}}
+	if file == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*LearnedRule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, rule := range rules {
+		if rule.Expires.After(now) && (rule.Action == config.ActionVpn || rule.Action == config.ActionDirect) {
+			l.rules[rule.Host] = rule
+		}
+	}
+
+	log.Printf("Loaded %d learned rules from %s", len(l.rules), file)
+
+	return l, nil
+}
+
+func learnedKey(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Get returns the learned route of host
+func (l *LearnedRules) Get(host string) (config.RouteAction, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	rule, ok := l.rules[learnedKey(host)]
+	if !ok {
+		return "", false
+	}
+
+	// the lookup is on the dial path, the file is left to SaveEvery or the next change
+	if time.Now().After(rule.Expires) {
+		delete(l.rules, rule.Host)
+		l.dirty = true
+		return "", false
+	}
+
+	return rule.Action, true
+}
+
+// Learn remembers that host is reached by action, for the ttl
+func (l *LearnedRules) Learn(host string, action config.RouteAction) {
+	key := learnedKey(host)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.rules[key]; !ok && len(l.rules) >= l.limit {
+		l.evict()
+	}
+
+	l.rules[key] = &LearnedRule{Host: key, Action: action, Expires: time.Now().Add(l.ttl)}
+	l.save()
+}
+
+// Forget drops the learned route of host, false if there was none
+func (l *LearnedRules) Forget(host string) bool {
+	key := learnedKey(host)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.rules[key]; !ok {
+		return false
+	}
+
+	delete(l.rules, key)
+	l.save()
+	return true
+}
+
+// List returns the learned rules sorted by host
+func (l *LearnedRules) List() []LearnedRule {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	rules := make([]LearnedRule, 0, len(l.rules))
+	for _, rule := range l.rules {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Host < rules[j].Host })
+
+	return rules
+}
+
+// evict drops the expired rules, or the one expiring first if none is. Must be called with the lock held.
+func (l *LearnedRules) evict() {
+	now := time.Now()
+
+	var first *LearnedRule
+	for key, rule := range l.rules {
+		if now.After(rule.Expires) {
+			delete(l.rules, key)
+			continue
+		}
+		if first == nil || rule.Expires.Before(first.Expires) {
+			first = rule
+		}
+	}
+
+	if len(l.rules) >= l.limit && first != nil {
+		delete(l.rules, first.Host)
+	}
+}
+
+// SaveEvery writes the rules dropped by the lookups to the file every interval, until stop is closed
+func (l *LearnedRules) SaveEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		l.lock.Lock()
+		if l.dirty {
+			l.save()
+		}
+		l.lock.Unlock()
+	}
+}
+
+// save writes the rules to the file, through a temporary one so a crash never leaves it half written.
+// Must be called with the lock held.
+func (l *LearnedRules) save() {
+	if l.file == "" {
+		return
+	}
+
+	rules := make([]*LearnedRule, 0, len(l.rules))
+	for _, rule := range l.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Host < rules[j].Host })
+
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		log.Printf("learned rules: %s", err.Error())
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.file), filepath.Base(l.file)+".*")
+	if err != nil {
+		log.Printf("learned rules: %s", err.Error())
+		return
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		log.Printf("learned rules: %s", err.Error())
+		return
+	}
+
+	l.dirty = false
+}
+
+// otherRoute the path not taken, only vpn and direct have one
+func otherRoute(action config.RouteAction) (config.RouteAction, bool) {
+	switch action {
+	case config.ActionVpn:
+		return config.ActionDirect, true
+	case config.ActionDirect:
+		return config.ActionVpn, true
+	}
+	return "", false
+}
+
+// dialSmart tries the route of the rules (or the learned one) first. If it fails within the fallback timeout,
+// the other route is tried, and remembered if it works.
+func (h *DefaultHandle) dialSmart(ctx context.Context, host string, candidates []*dialCandidate,
+	dialAll func(context.Context, []*dialCandidate) (net.Conn, *dialCandidate, error)) (net.Conn, *dialCandidate, error) {
+
+	primary := candidates
+	if action, ok := h.learned.Get(host); ok {
+		primary = make([]*dialCandidate, 0, len(candidates))
+		for _, c := range candidates {
+			primary = append(primary, &dialCandidate{ip: c.ip, action: action, rule: "learned"})
+		}
+	}
+
+	primaryCtx := ctx
+	if h.smartFallbackTimeout > 0 {
+		var cancel context.CancelFunc
+		primaryCtx, cancel = context.WithTimeout(ctx, h.smartFallbackTimeout)
+		defer cancel()
+	}
+
+	conn, winner, err := dialAll(primaryCtx, primary)
+	if err == nil || ctx.Err() != nil {
+		// connected, or the client gave up
+		return conn, winner, err
+	}
+
+	var fallback []*dialCandidate
+	for _, c := range primary {
+		if action, ok := otherRoute(c.action); ok {
+			fallback = append(fallback, &dialCandidate{ip: c.ip, action: action, rule: "fallback from " + string(c.action)})
+		}
+	}
+	if len(fallback) == 0 {
+		return nil, nil, err
+	}
+
+	log.Printf("smart routing: %s failed via %s: %s, trying %s", host, primary[0].action, err.Error(), fallback[0].action)
+
+	conn, winner, fallbackErr := dialAll(ctx, fallback)
+	if fallbackErr != nil {
+		return nil, nil, err
+	}
+
+	// a learned route stopped working and the rules were right after all
+	ruleAction := true
+	for _, c := range candidates {
+		if c.action != winner.action {
+			ruleAction = false
+		}
+	}
+
+	if ruleAction {
+		h.learned.Forget(host)
+	} else {
+		h.learned.Learn(host, winner.action)
+		log.Printf("smart routing: learned %s -> %s", host, winner.action)
+	}
+
+	return conn, winner, nil
+}
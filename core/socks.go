@@ -3,14 +3,17 @@ package core
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"EasierConnect/core/config"
@@ -22,203 +25,380 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
-var (
-	ipStack  *stack.Stack
-	selfIp   []byte
-	bindAddr string
-)
-
 type DefaultHandle struct {
-	myResolverMain *net.Resolver
-	myResolverBak  *net.Resolver
+	ipStack *stack.Stack
+	selfIp  []byte
+	rules   *config.Rules
+
+	// user defined rules, evaluated before or after the server rules according to their policy
+	localRules *config.LocalRules
+
+	// replaced by SetResolvers while dials read it
+	resolver atomic.Pointer[ResolverChain]
+
+	// answers of resolveDns, nil when caching is disabled
+	dnsCache *DnsCache
+
+	conns *ConnTable
+
+	// addresses tried last by the dialer
+	failedAddrs *failedAddrs
+
+	leakProtection   bool
+	intranetSuffixes []string
+
+	// limit of resolving and connecting a target, 0 for none
+	dialTimeout time.Duration
+
+	// client source addresses allowed on the listeners, nil allows everyone
+	acl *ClientAcl
+
+	// the socks5 udp relay, nil until ServeSocks5 started it
+	udp *udpRelay
+
+	// routes learned by the smart routing, nil when it is disabled
+	learned              *LearnedRules
+	smartFallbackTimeout time.Duration
 }
 
-// UDPExchange used to store client address and remote connection
-type UDPExchange struct {
-	ClientAddr *net.UDPAddr
-	RemoteConn *net.Conn
+func NewDefaultHandle(ipStack *stack.Stack, selfIp []byte, rules *config.Rules) *DefaultHandle {
+	h := &DefaultHandle{
+		ipStack:  ipStack,
+		selfIp:   selfIp,
+		rules:    rules,
+		dnsCache: NewDnsCache(DnsCacheSize),
+		conns:    NewConnTable(),
+
+		failedAddrs: newFailedAddrs(),
+
+		leakProtection:   DnsLeakProtection,
+		intranetSuffixes: splitSuffixes(IntranetSuffixes),
+
+		dialTimeout: time.Duration(DialTimeout) * time.Second,
+	}
+	_ = h.SetResolvers(nil, StrategyFallback)
+
+	return h
 }
 
-func (h *DefaultHandle) resolveDns(network string, domain string) (net.IP, error) {
-	var hasDnsRule bool
-	if config.IsDnsRuleAvailable() {
-		var dnsRules string
-		dnsRules, hasDnsRule = config.GetSingleDnsRule(domain)
+// SetResolvers replaces the dns upstreams, nil restores the default ones
+func (h *DefaultHandle) SetResolvers(upstreams []*ResolverUpstream, strategy string) error {
+	split := upstreams == nil
+	if split {
+		upstreams = DefaultResolverUpstreams(DnsUpstream)
+	}
 
-		if hasDnsRule {
-			return net.ParseIP(dnsRules), nil
+	resolver, err := NewResolverChain(h, upstreams, strategy)
+	if err != nil {
+		return err
+	}
+	resolver.split = split
+
+	h.resolver.Store(resolver)
+	h.dnsCache.Flush()
+
+	return nil
+}
+
+func splitSuffixes(suffixes string) []string {
+	var result []string
+	for _, suffix := range strings.Split(suffixes, ",") {
+		suffix = strings.ToLower(strings.Trim(strings.TrimSpace(suffix), "."))
+		if suffix != "" {
+			result = append(result, suffix)
 		}
 	}
+	return result
+}
 
-	if h.myResolverMain == nil {
-		h.myResolverMain = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				addrTarget := tcpip.FullAddress{
-					NIC:  defaultNIC,
-					Port: uint16(53),
-					Addr: tcpip.Address(net.ParseIP(config.GetDnsServer()[0])),
-				}
+// isIntranetName reports whether domain must only be resolved by the tunnel dns, dns rule exceptions never are
+func (h *DefaultHandle) isIntranetName(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
 
-				if network == "tcp" {
-					return gonet.DialTCP(ipStack, addrTarget, header.IPv4ProtocolNumber)
-				} else if network == "udp" {
-					return gonet.DialUDP(ipStack, nil, &addrTarget, header.IPv4ProtocolNumber)
-				}
+	if h.rules.IsDnsRuleException(domain) {
+		return false
+	}
 
-				d := net.Dialer{
-					Timeout: time.Millisecond * time.Duration(10000),
-				}
-				return d.DialContext(ctx, network, "223.5.5.5:53")
-			},
+	for _, suffix := range h.intranetSuffixes {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
 		}
 	}
 
-	if h.myResolverBak == nil {
-		h.myResolverBak = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				addrTarget := tcpip.FullAddress{
-					NIC:  defaultNIC,
-					Port: uint16(53),
-					Addr: tcpip.Address(net.ParseIP(config.GetDnsServer()[1])),
-				}
+	return h.rules.IsIntranet(domain)
+}
 
-				if network == "tcp" {
-					return gonet.DialTCP(ipStack, addrTarget, header.IPv4ProtocolNumber)
-				} else if network == "udp" {
-					return gonet.DialUDP(ipStack, nil, &addrTarget, header.IPv4ProtocolNumber)
-				}
+var ErrRejectedByRule = errors.New("connection rejected by rule")
 
-				d := net.Dialer{
-					Timeout: time.Millisecond * time.Duration(10000),
-				}
-				return d.DialContext(ctx, network, "223.5.5.5:53")
-			},
+var ErrTunnelIpv6 = errors.New("ipv6 is not supported through the tunnel")
+
+func (h *DefaultHandle) SetLocalRules(localRules *config.LocalRules) {
+	h.localRules = localRules
+}
+
+func (h *DefaultHandle) SetClientAcl(acl *ClientAcl) {
+	h.acl = acl
+}
+
+// SetSmartRouting makes the dialer fall back to the other route when the chosen one fails within fallbackTimeout,
+// nil learned disables it
+func (h *DefaultHandle) SetSmartRouting(learned *LearnedRules, fallbackTimeout time.Duration) {
+	h.learned = learned
+	h.smartFallbackTimeout = fallbackTimeout
+}
+
+// route decides how to reach domain:port, ip is the resolved address (nil if the resolution failed).
+// The returned string describes the rule that matched, for logging.
+func (h *DefaultHandle) route(domain string, ip net.IP, port int) (config.RouteAction, string) {
+	if h.localRules != nil && h.localRules.Policy == config.LocalRulesBefore {
+		if rule, ok := h.localRules.Match(domain, ip, port); ok {
+			return rule.Action, rule.String()
 		}
 	}
 
-	if len(config.GetDnsServer()) >= 1 && config.GetDnsServer()[0] != "0.0.0.0" {
-		ip, err := h.myResolverMain.LookupIP(context.Background(), "ip4", domain)
-		if err == nil {
-			log.Printf("Using custom dns server: %s Resolved: %s. ", config.GetDnsServer()[0], ip)
-			return ip[0], nil
+	if doProxy, rule := h.shouldProxy(domain, port); doProxy {
+		return config.ActionVpn, "server " + rule
+	}
+	if ip != nil {
+		if doProxy, rule := h.shouldProxy(ip.String(), port); doProxy {
+			return config.ActionVpn, "server " + rule
 		}
 	}
 
-	if len(config.GetDnsServer()) >= 2 && config.GetDnsServer()[1] != "0.0.0.0" {
-		ip, err := h.myResolverMain.LookupIP(context.Background(), "ip4", domain)
-		if err == nil {
-			log.Printf("Using custom dns server: %s Resolved: %s. ", config.GetDnsServer()[0], ip)
-			return ip[0], nil
+	if h.localRules != nil && h.localRules.Policy == config.LocalRulesAfter {
+		if rule, ok := h.localRules.Match(domain, ip, port); ok {
+			return rule.Action, rule.String()
 		}
 	}
 
-	// I think only ipv4 is supported.
-	result, err := net.ResolveIPAddr("ip4", domain)
+	return config.ActionDirect, "default"
+}
 
-	if err == nil {
-		return result.IP, nil
-	} else {
-		return nil, err
+// dialTunnelDns connects to port 53 of an intranet dns server through the tunnel
+func (h *DefaultHandle) dialTunnelDns(network string, server string) (net.Conn, error) {
+	addrTarget := tcpip.FullAddress{
+		NIC:  defaultNIC,
+		Port: uint16(53),
+		Addr: tcpip.Address(net.ParseIP(server).To4()),
+	}
+
+	if network == "tcp" {
+		return gonet.DialTCP(h.ipStack, addrTarget, header.IPv4ProtocolNumber)
 	}
+
+	return gonet.DialUDP(h.ipStack, nil, &addrTarget, header.IPv4ProtocolNumber)
 }
 
-func (h *DefaultHandle) shouldProxy(domain string, port int) bool {
-	var allowedPorts = []int{1, 65535} // [0] -> Min, [1] -> Max
-	var useL3transport = true
-	//	var hasDnsRule = false
+// lookupDns resolves through the resolver chain, the system resolver is the last resort when the chain has no public upstream
+func (h *DefaultHandle) lookupDns(domain string) ([]net.IP, time.Duration, error) {
+	resolver := h.resolver.Load()
 
-	var doProxy = false
+	ips, ttl, err := queryA(resolver.Exchange, domain)
+	if err == nil || isNotFound(err) || errors.Is(err, ErrDnsLeakBlocked) || resolver.hasPublicUpstream() {
+		return ips, ttl, err
+	}
 
-	if config.IsDomainRuleAvailable() {
-		allowedPorts, useL3transport = config.GetSingleDomainRule(domain)
+	// I think only ipv4 is supported.
+	ips, err = net.DefaultResolver.LookupIP(context.Background(), "ip4", domain)
+	if err != nil {
+		return nil, dnsNegativeTTL, err
 	}
 
-	if !useL3transport && config.IsIpv4RuleAvailable() && net.ParseIP(domain) != nil {
-		ip := net.ParseIP(domain)
-		if DebugDump {
-			log.Printf("Ipv4Rule is available ")
+	return ips, dnsSystemTTL, nil
+}
+
+// resolveDns returns all the addresses of domain, or the error of ctx once it is done
+func (h *DefaultHandle) resolveDns(ctx context.Context, network string, domain string) ([]net.IP, error) {
+	var hasDnsRule bool
+	if h.rules.IsDnsRuleAvailable() && !h.rules.IsDnsRuleException(domain) {
+		var dnsRules string
+		dnsRules, hasDnsRule = h.rules.GetSingleDnsRule(domain)
+
+		if hasDnsRule {
+			return []net.IP{net.ParseIP(dnsRules)}, nil
 		}
-		for _, rule := range *config.GetIpv4Rules() {
-			if rule.CIDR {
-				_, cidr, _ := net.ParseCIDR(rule.Rule)
-				if DebugDump {
-					log.Printf("Cidr test: %s %s %v", ip, rule.Rule, cidr.Contains(ip))
-				}
+	}
 
-				if cidr.Contains(ip) {
-					if DebugDump {
-						log.Printf("Cidr matched: %s %s", ip, rule.Rule)
-					}
+	if ip := net.ParseIP(domain); ip != nil {
+		return []net.IP{ip}, nil
+	}
 
-					useL3transport = true
-					allowedPorts = rule.Ports
-				}
-			} else {
-				if DebugDump {
-					log.Printf("raw match test: %s %s", ip, rule.Rule)
-				}
+	type lookupResult struct {
+		ips []net.IP
+		err error
+	}
 
-				ip1 := net.ParseIP(strings.Split(rule.Rule, "~")[0])
-				ip2 := net.ParseIP(strings.Split(rule.Rule, "~")[1])
+	// the lookup is shared with the other callers asking for domain, it is not cancelled with ctx
+	done := make(chan lookupResult, 1)
+	go func() {
+		ips, err := h.dnsCache.Lookup(domain, h.lookupDns)
+		done <- lookupResult{ips, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.ips, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-				if bytes.Compare(ip, ip1) >= 0 && bytes.Compare(ip, ip2) <= 0 {
-					if DebugDump {
-						log.Printf("raw matched: %s %s", ip1, ip2)
-					}
+func (h *DefaultHandle) shouldProxy(domain string, port int) (bool, string) {
+	doProxy, rule := h.rules.Match(domain, port)
 
-					useL3transport = true
-					allowedPorts = rule.Ports
-				}
-			}
-		}
+	if DebugDump {
+		log.Printf("Addr: %s:%v, matched rule: %s, doProxy: %v", domain, port, rule, doProxy)
 	}
 
-	// 泛域全网资源
-	if config.IsDomainRuleAvailable() {
-		allowAllWebSitesPorts, allowAllWebSites := config.GetSingleDomainRule("*")
+	return doProxy, rule
+}
 
-		if allowAllWebSites {
-			if allowAllWebSitesPorts[0] > 0 && allowAllWebSitesPorts[1] > 0 {
-				allowedPorts[0] = int(math.Min(float64(allowedPorts[0]), float64(allowAllWebSitesPorts[0])))
-				allowedPorts[1] = int(math.Max(float64(allowedPorts[1]), float64(allowAllWebSitesPorts[1])))
+// myDialer dials addr, the connection is tracked if ctx carries who asked for it (see withConnMeta).
+// Resolving and connecting give up after the dial timeout or once ctx is done.
+func (h *DefaultHandle) myDialer(ctx context.Context, network string, laddr *net.UDPAddr, addr string) (net.Conn, error) {
+	if h.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.dialTimeout)
+		defer cancel()
+	}
 
-				useL3transport = true
-			}
-		}
+	meta, ok := ctx.Value(connMetaKey{}).(*connMeta)
+	if !ok {
+		return h.dial(ctx, network, laddr, addr, nil)
 	}
 
-	log.Printf("Addr: %s:%v, AllowedPorts: %v, useL3transport: %v", domain, port, allowedPorts, useL3transport)
+	tracked, err := h.conns.open(meta, network, addr)
+	if err != nil {
+		log.Printf("%s: %s -> %s refused: %s", meta.listener, meta.client, addr, err.Error())
+		return nil, err
+	}
 
-	if /*(!useL3transport && hasDnsRule) || */ useL3transport && port >= allowedPorts[0] && port <= allowedPorts[1] {
-		doProxy = true
+	conn, err := h.dial(ctx, network, laddr, addr, tracked)
+	if err != nil {
+		tracked.setCloseReason("dial failed: " + err.Error())
+		_ = tracked.Close()
+		return nil, err
 	}
 
-	return doProxy
+	return tracked.established(conn), nil
 }
 
-func (h *DefaultHandle) myDialer(network string, laddr *net.UDPAddr, addr string) (net.Conn, error) {
+func (h *DefaultHandle) dial(ctx context.Context, network string, laddr *net.UDPAddr, addr string, tracked *trackedConn) (net.Conn, error) {
 
 	log.Printf("socks dial: %s", addr)
 
-	parts := strings.Split(addr, ":")
+	domain, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("invalid port: " + portStr)
+	}
+
+	ips, resolveErr := h.resolveDns(ctx, network, domain)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if resolveErr != nil {
+		ips = nil
+
+		// a direct dial would hand the name to the system resolver, i.e. to the public dns
+		if h.leakProtection && h.isIntranetName(domain) {
+			log.Printf("route: %s not resolved, not dialed: %s", addr, resolveErr.Error())
+			return nil, resolveErr
+		}
+	}
+
+	// the rules are applied to every address, rejected ones are not tried
+	var candidates []*dialCandidate
+	var rejected *dialCandidate
+	for _, ip := range ips {
+		action, rule := h.route(domain, ip, port)
+		log.Printf("route: %s (%s) -> %s (%s)", addr, ip, action, rule)
+
+		c := &dialCandidate{ip: ip, action: action, rule: rule}
+		if action == config.ActionReject {
+			rejected = c
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+
+	if len(ips) == 0 {
+		action, rule := h.route(domain, nil, port)
+		log.Printf("route: %s -> %s (%s)", addr, action, rule)
+
+		c := &dialCandidate{action: action, rule: rule}
+		if action == config.ActionReject {
+			rejected = c
+		} else {
+			candidates = append(candidates, c)
+		}
+	}
+
+	if len(candidates) == 0 {
+		tracked.setRoute(rejected.ip, rejected.action, rejected.rule)
+		return nil, ErrRejectedByRule
+	}
+
+	candidates = h.failedAddrs.sortCandidates(candidates, portStr)
+	tracked.setRoute(candidates[0].ip, candidates[0].action, candidates[0].rule)
+
+	dialOne := func(ctx context.Context, c *dialCandidate) (net.Conn, error) {
+		conn, dialErr := h.dialAddress(ctx, network, laddr, addr, port, c, resolveErr)
+		if c.ip != nil {
+			target := net.JoinHostPort(c.ip.String(), portStr)
+			if dialErr == nil {
+				h.failedAddrs.remove(target)
+			} else if ctx.Err() == nil {
+				h.failedAddrs.add(target)
+			}
+		}
+		return conn, dialErr
+	}
+
+	dialAll := func(ctx context.Context, candidates []*dialCandidate) (net.Conn, *dialCandidate, error) {
+		// udp is connectionless, there is nothing to race
+		if network == "udp" || len(candidates) == 1 {
+			conn, err := dialOne(ctx, candidates[0])
+			return conn, candidates[0], err
+		}
+		return dialParallel(ctx, candidates, dialOne)
+	}
 
-	domain := parts[0]
-	port, err := strconv.Atoi(parts[1])
+	var conn net.Conn
+	var winner *dialCandidate
+	// a udp dial cannot fail on the wrong route, there is nothing to fall back from
+	if h.learned != nil && network != "udp" {
+		conn, winner, err = h.dialSmart(ctx, domain, candidates, dialAll)
+	} else {
+		conn, winner, err = dialAll(ctx, candidates)
+	}
 	if err != nil {
-		return nil, errors.New("invalid port: " + parts[1])
+		return nil, err
 	}
 
-	dnsResult, err := h.resolveDns(network, domain)
+	tracked.setRoute(winner.ip, winner.action, winner.rule)
+	return conn, nil
+}
+
+// dialAddress connects to one address of addr, resolveErr is returned when the tunnel is chosen without an address
+func (h *DefaultHandle) dialAddress(ctx context.Context, network string, laddr *net.UDPAddr, addr string, port int, c *dialCandidate, resolveErr error) (net.Conn, error) {
+	if c.action == config.ActionVpn {
+		if c.ip == nil {
+			return nil, resolveErr
+		}
 
-	doProxy := err == nil && (h.shouldProxy(domain, port) || h.shouldProxy(dnsResult.String(), port))
+		ip4 := c.ip.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("%w: %s", ErrTunnelIpv6, c.ip)
+		}
 
-	if doProxy {
 		addrTarget := tcpip.FullAddress{
 			NIC:  defaultNIC,
 			Port: uint16(port),
-			Addr: tcpip.Address(dnsResult),
+			Addr: tcpip.Address(ip4),
 		}
 
 		if network == "udp" {
@@ -231,45 +411,56 @@ func (h *DefaultHandle) myDialer(network string, laddr *net.UDPAddr, addr string
 					Addr: tcpip.Address(laddr.IP),
 				}
 			}
-			return gonet.DialUDP(ipStack, bind, &addrTarget, header.IPv4ProtocolNumber)
+			return gonet.DialUDP(h.ipStack, bind, &addrTarget, header.IPv4ProtocolNumber)
 		} else {
 			bind := tcpip.FullAddress{
 				NIC:  defaultNIC,
-				Addr: tcpip.Address(selfIp),
+				Addr: tcpip.Address(h.selfIp),
 			}
 
-			return gonet.DialTCPWithBind(context.Background(), ipStack, bind, addrTarget, header.IPv4ProtocolNumber)
+			conn, err := gonet.DialTCPWithBind(ctx, h.ipStack, bind, addrTarget, header.IPv4ProtocolNumber)
+			if err != nil {
+				return nil, tunnelDialError(err)
+			}
+			return conn, nil
 		}
 	}
 
 	log.Printf("skip: %s", addr)
 
+	// dial the address the rules were applied to, the system resolver is only used when ours failed
+	target := addr
+	if c.ip != nil {
+		target = net.JoinHostPort(c.ip.String(), strconv.Itoa(port))
+	}
+
 	if network == "udp" {
-		udpAddr, err0 := net.ResolveUDPAddr(network, addr)
+		udpAddr, err0 := net.ResolveUDPAddr(network, target)
 		if err0 == nil {
 			return net.DialUDP(network, laddr, udpAddr)
 		} else {
 			return nil, err0
 		}
 	} else {
-		return net.Dial(network, addr)
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
 	}
 }
 
-func (h *DefaultHandle) ConnectTcp(r *txSocks5.Request, w io.Writer) (net.Conn, error) {
+func (h *DefaultHandle) ConnectTcp(ctx context.Context, r *txSocks5.Request, w io.Writer) (net.Conn, error) {
 	if txSocks5.Debug {
 		log.Println("Call:", r.Address())
 	}
-	rc, err := h.myDialer("tcp", nil, r.Address())
+	rc, err := h.myDialer(ctx, "tcp", nil, r.Address())
 	if err != nil {
 		var p *txSocks5.Reply
 		if r.Atyp == txSocks5.ATYPIPv4 || r.Atyp == txSocks5.ATYPDomain {
-			p = txSocks5.NewReply(txSocks5.RepHostUnreachable, txSocks5.ATYPIPv4, []byte{0x00, 0x00, 0x00, 0x00}, []byte{0x00, 0x00})
+			p = txSocks5.NewReply(socks5ReplyCode(err), txSocks5.ATYPIPv4, []byte{0x00, 0x00, 0x00, 0x00}, []byte{0x00, 0x00})
 		} else {
-			p = txSocks5.NewReply(txSocks5.RepHostUnreachable, txSocks5.ATYPIPv6, net.IPv6zero, []byte{0x00, 0x00})
+			p = txSocks5.NewReply(socks5ReplyCode(err), txSocks5.ATYPIPv6, net.IPv6zero, []byte{0x00, 0x00})
 		}
-		if _, err = p.WriteTo(w); err != nil {
-			return nil, err
+		if _, werr := p.WriteTo(w); werr != nil {
+			return nil, werr
 		}
 		return nil, err
 	}
@@ -300,197 +491,249 @@ func (h *DefaultHandle) ConnectTcp(r *txSocks5.Request, w io.Writer) (net.Conn,
 
 // TCPHandle auto handle request. You may prefer to do yourself.
 func (h *DefaultHandle) TCPHandle(s *txSocks5.Server, c *net.TCPConn, r *txSocks5.Request) error {
+	return h.handleSocks5Request(s, c, r)
+}
+
+// handleSocks5Request c is a tcp or unix socket connection, udp can only be associated over tcp
+func (h *DefaultHandle) handleSocks5Request(s *txSocks5.Server, c net.Conn, r *txSocks5.Request) error {
 	if r.Cmd == txSocks5.CmdConnect {
-		rc, err := h.ConnectTcp(r, c)
+		ctx, stopWatch := watchClient(withConnMeta(context.Background(), "socks5", clientAddr(c), c), c)
+		rc, err := h.ConnectTcp(ctx, r, c)
+		early := stopWatch()
 		if err != nil {
 			return err
 		}
-		defer func(rc net.Conn) {
-			_ = rc.Close()
-		}(rc)
-		go func() {
-			var bf [1024 * 2]byte
-			for {
-				if rc == nil {
-					return
-				}
-				if s.TCPTimeout != 0 {
-					if err = rc.SetDeadline(time.Now().Add(time.Duration(s.TCPTimeout) * time.Second)); err != nil {
-						return
-					}
-				}
-				i, err0 := rc.Read(bf[:])
-				if err0 != nil {
-					return
-				}
-				if _, err = c.Write(bf[0:i]); err != nil {
-					return
-				}
-			}
-		}()
-		var bf [1024 * 2]byte
-		for {
-			if c == nil {
-				break
-			}
-			if s.TCPTimeout != 0 {
-				if err = c.SetDeadline(time.Now().Add(time.Duration(s.TCPTimeout) * time.Second)); err != nil {
-					return nil
-				}
-			}
-			i, err0 := c.Read(bf[:])
-			if err0 != nil {
-				return nil
-			}
-			if _, err = rc.Write(bf[0:i]); err != nil {
-				return nil
+
+		if len(early) > 0 {
+			if _, err = rc.Write(early); err != nil {
+				_ = rc.Close()
+				return err
 			}
 		}
+
+		reason := relay(c, rc, time.Duration(s.TCPTimeout)*time.Second)
+		log.Printf("socks5: %s -> %s closed: %s", clientAddr(c), r.Address(), reason)
+
+		return nil
+	}
+	if r.Cmd == txSocks5.CmdBind {
+		return h.bindSocks5(s, c, r)
 	}
 	if r.Cmd == txSocks5.CmdUDP {
-		caddr, err := r.UDP(c, s.ServerAddr)
-		if err != nil {
-			return err
-		}
-		ch := make(chan byte)
-		defer close(ch)
-		s.AssociatedUDP.Set(caddr.String(), ch, -1)
-		defer s.AssociatedUDP.Delete(caddr.String())
-		io.Copy(io.Discard, c)
-		if txSocks5.Debug {
-			log.Printf("A tcp connection that udp %#v associated closed\n", caddr.String())
+		tcpConn, ok := c.(*net.TCPConn)
+		if !ok || h.udp == nil {
+			_ = writeSocks5Reply(c, txSocks5.RepCommandNotSupported, nil)
+			return txSocks5.ErrUnsupportCmd
 		}
-		return nil
+
+		return h.udp.serveAssociate(tcpConn, r)
 	}
 	return txSocks5.ErrUnsupportCmd
 }
 
-// UDPHandle auto handle packet. You may prefer to do yourself.
-func (h *DefaultHandle) UDPHandle(s *txSocks5.Server, addr *net.UDPAddr, d *txSocks5.Datagram) error {
-	src := addr.String()
-	var ch chan byte
-	if s.LimitUDP {
-		any11, ok := s.AssociatedUDP.Get(src)
-		if !ok {
-			return fmt.Errorf("this udp address %s is not associated with tcp", src)
+// tunnelErrnos the netstack errors, gonet only keeps their message
+var tunnelErrnos = map[string]syscall.Errno{
+	"connection was refused": syscall.ECONNREFUSED,
+	"network is unreachable": syscall.ENETUNREACH,
+	"no route to host":       syscall.EHOSTUNREACH,
+	"operation timed out":    syscall.ETIMEDOUT,
+}
+
+// tunnelDialError gives a failed tunnel connect the errno a direct one would have, so both are told apart the same way
+func tunnelDialError(err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		if errno, ok := tunnelErrnos[opErr.Err.Error()]; ok {
+			return &net.OpError{Op: opErr.Op, Net: opErr.Net, Addr: opErr.Addr, Err: errno}
 		}
-		ch = any11.(chan byte)
-	}
-	send := func(ue *UDPExchange, data []byte) error {
-		select {
-		case <-ch:
-			return fmt.Errorf("this udp address %s is not associated with tcp", src)
-		default:
-			_, err := (*ue.RemoteConn).Write(data)
-			if err != nil {
-				return err
-			}
-			if txSocks5.Debug {
-				log.Printf("Sent UDP data to remote. client: %#v server: %#v remote: %#v data: %#v\n", ue.ClientAddr.String(), (*ue.RemoteConn).LocalAddr().String(), (*ue.RemoteConn).RemoteAddr().String(), data)
-			}
+	}
+	return err
+}
+
+// isDialTimeout whether a connect failed because the target did not answer in time
+func isDialTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT) || isTimeout(err)
+}
+
+// socks5ReplyCode the reply to a connect that failed with err
+func socks5ReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, ErrConnLimited) || errors.Is(err, ErrRejectedByRule):
+		return txSocks5.RepNotAllowed
+	case errors.Is(err, ErrTunnelIpv6):
+		return txSocks5.RepAddressNotSupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return txSocks5.RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return txSocks5.RepNetworkUnreachable
+	case isDialTimeout(err):
+		return txSocks5.RepTTLExpired
+	}
+	return txSocks5.RepHostUnreachable
+}
+
+func writeSocks5Reply(w io.Writer, rep byte, addr *net.TCPAddr) error {
+	atyp := txSocks5.ATYPIPv4
+	ip := net.IPv4zero.To4()
+	port := []byte{0x00, 0x00}
+	if addr != nil {
+		if ip = addr.IP.To4(); ip == nil {
+			atyp, ip = txSocks5.ATYPIPv6, addr.IP.To16()
 		}
-		return nil
+		binary.BigEndian.PutUint16(port, uint16(addr.Port))
 	}
 
-	dst := d.Address()
-	var ue *UDPExchange
-	iue, ok := s.UDPExchanges.Get(src + dst)
-	if ok {
-		ue = iue.(*UDPExchange)
-		return send(ue, d.Data)
+	_, err := txSocks5.NewReply(rep, atyp, ip, port).WriteTo(w)
+	return err
+}
+
+// bindSocks5 listens on the virtual ip, the first reply carries the listening address, the second one the connected host
+func (h *DefaultHandle) bindSocks5(s *txSocks5.Server, c net.Conn, r *txSocks5.Request) error {
+	var expected net.IP
+	if r.Atyp == txSocks5.ATYPIPv4 {
+		expected = net.IP(r.DstAddr)
 	}
 
-	if txSocks5.Debug {
-		log.Printf("Call udp: %#v\n", dst)
+	b, err := h.bindTunnel(withConnMeta(context.Background(), "socks5", clientAddr(c), c), r.Address(), expected)
+	if err != nil {
+		rep := txSocks5.RepServerFailure
+		if errors.Is(err, ErrConnLimited) {
+			rep = txSocks5.RepNotAllowed
+		}
+		_ = writeSocks5Reply(c, rep, nil)
+		return err
 	}
-	var laddr *net.UDPAddr
-	any11, ok := s.UDPSrc.Get(src + dst)
-	if ok {
-		laddr = any11.(*net.UDPAddr)
+
+	if err = writeSocks5Reply(c, txSocks5.RepSuccess, b.Addr()); err != nil {
+		b.Close()
+		return err
 	}
-	rc, err := h.myDialer("udp", laddr, dst)
+
+	log.Printf("socks5: bind %s for %s on %s", clientAddr(c), r.Address(), b.Addr())
+
+	rc, err := b.Accept(c)
 	if err != nil {
-		if !strings.Contains(err.Error(), "address already in use") {
-			return err
+		_ = writeSocks5Reply(c, txSocks5.RepTTLExpired, nil)
+		return err
+	}
+
+	if err = writeSocks5Reply(c, txSocks5.RepSuccess, rc.RemoteAddr().(*net.TCPAddr)); err != nil {
+		_ = rc.Close()
+		return err
+	}
+
+	reason := relay(c, rc, time.Duration(s.TCPTimeout)*time.Second)
+	log.Printf("socks5: bind %s <- %s closed: %s", clientAddr(c), rc.RemoteAddr(), reason)
+
+	return nil
+}
+
+// serveSocks5Conn serves one client of the socks port: socks4 or socks5 negotiation, auth, then the request
+func serveSocks5Conn(s *txSocks5.Server, h *DefaultHandle, auth *SocksAuth, c net.Conn) {
+	defer c.Close()
+
+	if s.TCPTimeout != 0 {
+		if err := c.SetDeadline(time.Now().Add(time.Duration(s.TCPTimeout) * time.Second)); err != nil {
+			log.Println(err)
+			return
 		}
-		rc, err = h.myDialer("udp", nil, dst)
-		if err != nil {
-			return err
+	}
+
+	// socks4 and socks5 share the port, told apart by the version byte
+	var version [1]byte
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		log.Println(err)
+		return
+	}
+
+	if version[0] == socks4Version {
+		if err := serveSocks4Conn(s, h, auth, c); err != nil {
+			log.Println(err)
 		}
-		laddr = nil
+		return
 	}
-	if rc == nil {
-		return err
+
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{io.MultiReader(bytes.NewReader(version[:]), c), c}
+
+	username, err := negotiateSocks5(rw, auth, clientAddr(c))
+	if err != nil {
+		log.Println(err)
+		return
 	}
-	if laddr == nil {
-		s.UDPSrc.Set(src+dst, rc.LocalAddr().(*net.UDPAddr), -1)
+
+	if auth != nil {
+		auth.connOpened(username)
+		defer auth.connClosed(username)
 	}
-	ue = &UDPExchange{
-		ClientAddr: addr,
-		RemoteConn: &rc,
+
+	r, err := s.GetRequest(c)
+	if err != nil {
+		log.Println(err)
+		return
 	}
-	if txSocks5.Debug {
-		log.Printf("Created remote UDP conn for client. client: %#v server: %#v remote: %#v\n", addr.String(), (*ue.RemoteConn).LocalAddr().String(), d.Address())
+
+	if err = h.handleSocks5Request(s, c, r); err != nil {
+		log.Println(err)
 	}
-	if err = send(ue, d.Data); err != nil {
-		(*ue.RemoteConn).Close()
-		return err
+}
+
+// ServeSocks5 listens on every address of the comma separated bindAddr, "unix:/path" for a unix socket.
+// Udp is relayed on the first tcp address only.
+func ServeSocks5(h *DefaultHandle, bindAddr string, auth *SocksAuth) {
+	txSocks5.Debug = true
+
+	udpBind := firstTcpBind(bindAddr)
+	serverBind := udpBind
+	if serverBind == "" {
+		// unix sockets only, there is nothing to associate udp with
+		serverBind = "127.0.0.1:0"
 	}
-	s.UDPExchanges.Set(src+dst, ue, -1)
-	go func(ue *UDPExchange, dst string) {
-		defer func() {
-			(*ue.RemoteConn).Close()
-			s.UDPExchanges.Delete(ue.ClientAddr.String() + dst)
-		}()
-		var b [65507]byte
-		for {
-			select {
-			case <-ch:
-				if txSocks5.Debug {
-					log.Printf("The tcp that udp address %s associated closed\n", ue.ClientAddr.String())
-				}
-				return
-			default:
-				if s.UDPTimeout != 0 {
-					if err = (*ue.RemoteConn).SetDeadline(time.Now().Add(time.Duration(s.UDPTimeout) * time.Second)); err != nil {
-						log.Println(err)
-						return
-					}
-				}
-				n, err0 := (*ue.RemoteConn).Read(b[:])
-				if err0 != nil {
-					return
-				}
-				if txSocks5.Debug {
-					log.Printf("Got UDP data from remote. client: %#v server: %#v remote: %#v data: %#v\n", ue.ClientAddr.String(), (*ue.RemoteConn).LocalAddr().String(), (*ue.RemoteConn).RemoteAddr().String(), b[0:n])
-				}
-				a, addr1, port, err1 := txSocks5.ParseAddress(dst)
-				if err1 != nil {
-					log.Println(err1)
-					return
-				}
-				if a == txSocks5.ATYPDomain {
-					addr1 = addr1[1:]
-				}
-				d1 := txSocks5.NewDatagram(a, addr1, port, b[0:n])
-				if _, err = s.UDPConn.WriteToUDP(d1.Bytes(), ue.ClientAddr); err != nil {
+
+	s, err := txSocks5.NewClassicServer(serverBind, "127.0.0.1", "", "", 5000, UdpTimeout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	listeners, err := listenAll("socks5", bindAddr, h.acl)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if udpBind != "" {
+		udpConn, err := net.ListenUDP("udp", s.UDPAddr)
+		if err != nil {
+			log.Printf("Socks5 udp server stopped: %s", err.Error())
+		} else {
+			// only clients passed the tcp negotiation may relay udp
+			h.udp = newUdpRelay(h, udpConn, auth != nil, time.Duration(UdpTimeout)*time.Second, UdpMaxDestinations)
+			go h.udp.serve()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+
+		go func(l net.Listener) {
+			defer wg.Done()
+			defer l.Close()
+
+			log.Printf("Socks5 server listening on %s", l.Addr())
+
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					log.Printf("Socks5 tcp server stopped: %s", err.Error())
 					return
 				}
-				if txSocks5.Debug {
-					log.Printf("Sent Datagram. client: %#v server: %#v remote: %#v data: %#v %#v %#v %#v %#v %#v datagram address: %#v\n", ue.ClientAddr.String(), (*ue.RemoteConn).LocalAddr().String(), (*ue.RemoteConn).RemoteAddr().String(), d1.Rsv, d1.Frag, d1.Atyp, d1.DstAddr, d1.DstPort, d1.Data, d1.Address())
-				}
-			}
-		}
-	}(ue, dst)
-	return nil
-}
 
-func ServeSocks5(ipStack_ *stack.Stack, selfIp_ []byte, bindAddr_ string) {
-	ipStack = ipStack_
-	selfIp = selfIp_
-	bindAddr = bindAddr_
+				go serveSocks5Conn(s, h, auth, c)
+			}
+		}(l)
+	}
 
-	txSocks5.Debug = true
-	s, _ := txSocks5.NewClassicServer(SocksBind, "127.0.0.1", "", "", 5000, 5000)
-	s.ListenAndServe(&DefaultHandle{})
+	wg.Wait()
 }
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	txSocks5 "github.com/txthinking/socks5"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4CmdConnect = 0x01
+	socks4CmdBind    = 0x02
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// readNullTerminated reads a socks4 user id or socks4a host name, one byte at a time so nothing after it is consumed
+func readNullTerminated(r io.Reader) (string, error) {
+	var buf []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= 255 {
+			return "", errors.New("socks4: field too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+func writeSocks4Reply(w io.Writer, code byte, addr *net.TCPAddr) error {
+	reply := make([]byte, 8)
+	reply[1] = code
+	if addr != nil {
+		binary.BigEndian.PutUint16(reply[2:4], uint16(addr.Port))
+		copy(reply[4:8], addr.IP.To4())
+	}
+
+	_, err := w.Write(reply)
+	return err
+}
+
+// serveSocks4Conn handles a socks4 or socks4a request, the version byte has already been read
+func serveSocks4Conn(s *txSocks5.Server, h *DefaultHandle, auth *SocksAuth, c net.Conn) error {
+	var request [7]byte
+	if _, err := io.ReadFull(c, request[:]); err != nil {
+		return err
+	}
+
+	cmd := request[0]
+	port := binary.BigEndian.Uint16(request[1:3])
+	ip := net.IP(request[3:7])
+
+	userId, err := readNullTerminated(c)
+	if err != nil {
+		return err
+	}
+
+	host := ip.String()
+	// socks4a: 0.0.0.x with x != 0 means the host name follows
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = readNullTerminated(c); err != nil {
+			return err
+		}
+		// a placeholder, not the host, any host may connect back to a bind (as for socks5 domain names)
+		ip = nil
+	}
+
+	// socks4 has no password, it cannot be used when the server requires authentication
+	if auth != nil {
+		log.Printf("socks4 auth failed: client %s, user id %s, socks4 is not allowed with authentication", clientAddr(c), userId)
+		_ = writeSocks4Reply(c, socks4Rejected, nil)
+		return txSocks5.ErrUserPassAuth
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	ctx := withConnMeta(context.Background(), "socks4", clientAddr(c), c)
+	idleTimeout := time.Duration(s.TCPTimeout) * time.Second
+
+	switch cmd {
+	case socks4CmdConnect:
+		dialCtx, stopWatch := watchClient(ctx, c)
+		rc, err := h.myDialer(dialCtx, "tcp", nil, addr)
+		early := stopWatch()
+		if err != nil {
+			_ = writeSocks4Reply(c, socks4Rejected, nil)
+			return err
+		}
+
+		if err = writeSocks4Reply(c, socks4Granted, nil); err != nil {
+			_ = rc.Close()
+			return err
+		}
+
+		if len(early) > 0 {
+			if _, err = rc.Write(early); err != nil {
+				_ = rc.Close()
+				return err
+			}
+		}
+
+		reason := relay(c, rc, idleTimeout)
+		log.Printf("socks4: %s -> %s closed: %s", clientAddr(c), addr, reason)
+
+		return nil
+	case socks4CmdBind:
+		b, err := h.bindTunnel(ctx, addr, ip)
+		if err != nil {
+			_ = writeSocks4Reply(c, socks4Rejected, nil)
+			return err
+		}
+
+		if err = writeSocks4Reply(c, socks4Granted, b.Addr()); err != nil {
+			b.Close()
+			return err
+		}
+
+		log.Printf("socks4: bind %s for %s on %s", clientAddr(c), addr, b.Addr())
+
+		rc, err := b.Accept(c)
+		if err != nil {
+			_ = writeSocks4Reply(c, socks4Rejected, nil)
+			return err
+		}
+
+		if err = writeSocks4Reply(c, socks4Granted, rc.RemoteAddr().(*net.TCPAddr)); err != nil {
+			_ = rc.Close()
+			return err
+		}
+
+		reason := relay(c, rc, idleTimeout)
+		log.Printf("socks4: bind %s <- %s closed: %s", clientAddr(c), rc.RemoteAddr(), reason)
+
+		return nil
+	}
+
+	_ = writeSocks4Reply(c, socks4Rejected, nil)
+	return txSocks5.ErrUnsupportCmd
+}
@@ -0,0 +1,260 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	txSocks5 "github.com/txthinking/socks5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SocksUserStats per-user connection accounting
+type SocksUserStats struct {
+	Active int64
+	Total  int64
+	Failed int64
+}
+
+// SocksAuth RFC 1929 username/password authentication for the socks5 server
+type SocksAuth struct {
+	lock  sync.RWMutex
+	users map[string]string // username -> plain password or htpasswd hash
+	stats map[string]*SocksUserStats
+}
+
+func NewSocksAuth() *SocksAuth {
+	return &SocksAuth{
+		users: map[string]string{},
+		stats: map[string]*SocksUserStats{},
+	}
+}
+
+// NewSocksAuthFrom builds the authenticator from a single user and/or a htpasswd-style file, nil if neither is set
+func NewSocksAuthFrom(username, password, authFile string) (*SocksAuth, error) {
+	if username == "" && authFile == "" {
+		return nil, nil
+	}
+
+	auth := NewSocksAuth()
+
+	if username != "" {
+		if password == "" {
+			return nil, errors.New("socks5 password is empty for user " + username)
+		}
+		auth.AddUser(username, password)
+	}
+
+	if authFile != "" {
+		if err := auth.LoadFile(authFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return auth, nil
+}
+
+func (a *SocksAuth) AddUser(username, password string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.users[username] = password
+	if _, ok := a.stats[username]; !ok {
+		a.stats[username] = &SocksUserStats{}
+	}
+}
+
+// LoadFile loads `user:password` lines, the password may be plain text, bcrypt ($2y$...) or {SHA} as written by htpasswd
+func (a *SocksAuth) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" || password == "" {
+			log.Printf("Ignoring invalid line in socks5 auth file: %s", line)
+			continue
+		}
+
+		if err = checkPasswordFormat(password); err != nil {
+			return errors.New("socks5 auth file, user " + username + ": " + err.Error())
+		}
+
+		a.AddUser(username, password)
+		count++
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Loaded %v socks5 users from %s", count, path)
+
+	return nil
+}
+
+func isBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// checkPasswordFormat rejects the htpasswd hashes Verify cannot check ($apr1$ md5, crypt...),
+// they would otherwise be compared as plain text
+func checkPasswordFormat(password string) error {
+	switch {
+	case isBcrypt(password), strings.HasPrefix(password, "{SHA}"):
+		return nil
+	case strings.HasPrefix(password, "$"), strings.HasPrefix(password, "{"):
+		return errors.New("unsupported password hash, use bcrypt (htpasswd -B) or {SHA}")
+	}
+	return nil
+}
+
+func (a *SocksAuth) Verify(username, password string) bool {
+	a.lock.RLock()
+	stored, ok := a.users[username]
+	a.lock.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	switch {
+	case isBcrypt(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(stored[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+// authenticate is Verify for a client of listener, failures are logged and counted
+func (a *SocksAuth) authenticate(listener, client, username, password string) bool {
+	if a.Verify(username, password) {
+		return true
+	}
+
+	if stats := a.userStats(username); stats != nil {
+		atomic.AddInt64(&stats.Failed, 1)
+	}
+	log.Printf("%s auth failed: client %s, user %s", listener, client, username)
+
+	return false
+}
+
+// Stats returns a copy of the accounting of every known user
+func (a *SocksAuth) Stats() map[string]SocksUserStats {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	result := make(map[string]SocksUserStats, len(a.stats))
+	for username, stats := range a.stats {
+		result[username] = SocksUserStats{
+			Active: atomic.LoadInt64(&stats.Active),
+			Total:  atomic.LoadInt64(&stats.Total),
+			Failed: atomic.LoadInt64(&stats.Failed),
+		}
+	}
+
+	return result
+}
+
+func (a *SocksAuth) userStats(username string) *SocksUserStats {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.stats[username]
+}
+
+// connOpened / connClosed keep track of the connections of an authenticated user
+func (a *SocksAuth) connOpened(username string) {
+	if stats := a.userStats(username); stats != nil {
+		active := atomic.AddInt64(&stats.Active, 1)
+		total := atomic.AddInt64(&stats.Total, 1)
+
+		log.Printf("socks5 user %s: connection opened, active: %v, total: %v", username, active, total)
+	}
+}
+
+func (a *SocksAuth) connClosed(username string) {
+	if stats := a.userStats(username); stats != nil {
+		active := atomic.AddInt64(&stats.Active, -1)
+
+		log.Printf("socks5 user %s: connection closed, active: %v", username, active)
+	}
+}
+
+// negotiateSocks5 performs the socks5 method negotiation, and the RFC 1929 sub-negotiation when auth is enabled.
+// It returns the authenticated username, empty if auth is disabled.
+func negotiateSocks5(rw io.ReadWriter, auth *SocksAuth, client string) (string, error) {
+	rq, err := txSocks5.NewNegotiationRequestFrom(rw)
+	if err != nil {
+		return "", err
+	}
+
+	method := txSocks5.MethodNone
+	if auth != nil {
+		method = txSocks5.MethodUsernamePassword
+	}
+
+	supported := false
+	for _, m := range rq.Methods {
+		if m == method {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		if auth != nil {
+			log.Printf("socks5 auth failed: client %s does not support username/password auth", client)
+		}
+
+		_, _ = txSocks5.NewNegotiationReply(txSocks5.MethodUnsupportAll).WriteTo(rw)
+		return "", errors.New("no acceptable socks5 method from " + client)
+	}
+
+	if _, err = txSocks5.NewNegotiationReply(method).WriteTo(rw); err != nil {
+		return "", err
+	}
+
+	if auth == nil {
+		return "", nil
+	}
+
+	urq, err := txSocks5.NewUserPassNegotiationRequestFrom(rw)
+	if err != nil {
+		return "", err
+	}
+
+	username := string(urq.Uname)
+	if !auth.authenticate("socks5", client, username, string(urq.Passwd)) {
+		_, _ = txSocks5.NewUserPassNegotiationReply(txSocks5.UserPassStatusFailure).WriteTo(rw)
+		return "", txSocks5.ErrUserPassAuth
+	}
+
+	if _, err = txSocks5.NewUserPassNegotiationReply(txSocks5.UserPassStatusSuccess).WriteTo(rw); err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
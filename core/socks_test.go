@@ -0,0 +1,59 @@
+package core
+
+import (
+	"EasierConnect/core/config"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouteLocalRulesPolicy(t *testing.T) {
+	rules := config.NewRules()
+	rules.AppendSingleDomainRule("intra.example.com", []int{1, 65535}, false)
+	rules.AppendSingleIpv4RangeRule("10.0.0.0~10.255.255.255", []int{1, 65535}, false, false)
+
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	local := "domain,intra.example.com,direct\ndomain,public.example.com,vpn\ncidr,10.1.0.0/16,reject\n"
+	if err := os.WriteFile(path, []byte(local), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy string
+		domain string
+		ip     string
+		want   config.RouteAction
+	}{
+		// local rules first: they override the server rules
+		{config.LocalRulesBefore, "intra.example.com", "", config.ActionDirect},
+		{config.LocalRulesBefore, "public.example.com", "", config.ActionVpn},
+		{config.LocalRulesBefore, "10.1.2.3", "", config.ActionReject},
+		{config.LocalRulesBefore, "resolved.example.com", "10.1.2.3", config.ActionReject},
+		{config.LocalRulesBefore, "10.2.0.1", "", config.ActionVpn},
+		{config.LocalRulesBefore, "other.example.org", "", config.ActionDirect},
+
+		// local rules after: they only apply to what the server rules leave direct
+		{config.LocalRulesAfter, "intra.example.com", "", config.ActionVpn},
+		{config.LocalRulesAfter, "public.example.com", "", config.ActionVpn},
+		{config.LocalRulesAfter, "10.1.2.3", "", config.ActionVpn},
+		{config.LocalRulesAfter, "resolved.example.com", "10.1.2.3", config.ActionVpn},
+		{config.LocalRulesAfter, "other.example.org", "", config.ActionDirect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.domain, func(t *testing.T) {
+			localRules, err := config.LoadLocalRules(path, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := &DefaultHandle{rules: rules}
+			h.SetLocalRules(localRules)
+
+			if got, rule := h.route(tt.domain, net.ParseIP(tt.ip), 443); got != tt.want {
+				t.Errorf("route(%s, %s) = %s (%s), want %s", tt.domain, tt.ip, got, rule, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// from linux/netfilter_ipv4.h
+const soOriginalDst = 80
+
+const transparentUdpTimeout = 60 * time.Second
+
+func setTransparent(network, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+			return
+		}
+		if network == "udp" || network == "udp4" {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// originalDst the destination of a connection redirected by iptables REDIRECT, read from conntrack
+func originalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var mreq *syscall.IPv6Mreq
+	controlErr := raw.Control(func(fd uintptr) {
+		// the sockaddr_in fits in the 16 bytes of an IPv6Mreq
+		mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+	})
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	addr := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(addr[4], addr[5], addr[6], addr[7]),
+		Port: int(binary.BigEndian.Uint16(addr[2:4])),
+	}, nil
+}
+
+func serveTransparentTcpConn(h *DefaultHandle, c *net.TCPConn, listenAddr *net.TCPAddr) {
+	defer c.Close()
+
+	// REDIRECT rewrites the destination, TPROXY leaves it as the local address of the connection
+	dst, err := originalDst(c)
+	if err != nil {
+		dst = c.LocalAddr().(*net.TCPAddr)
+	}
+
+	if dst.Port == listenAddr.Port && (dst.IP.IsLoopback() || dst.IP.Equal(listenAddr.IP) || (listenAddr.IP.IsUnspecified() && isLocalIp(dst.IP))) {
+		log.Printf("transparent: %s connected to the proxy itself, not redirected", c.RemoteAddr())
+		return
+	}
+
+	addr := dst.String()
+	ctx, stopWatch := watchClient(withConnMeta(context.Background(), "transparent", c.RemoteAddr().String(), c), c)
+	rc, err := h.myDialer(ctx, "tcp", nil, addr)
+	early := stopWatch()
+	if err != nil {
+		log.Printf("transparent: %s -> %s failed: %s", c.RemoteAddr(), addr, err.Error())
+		return
+	}
+
+	// the client does not wait for a reply, it may have sent its request already
+	if len(early) > 0 {
+		if _, err = rc.Write(early); err != nil {
+			_ = rc.Close()
+			return
+		}
+	}
+
+	reason := relay(c, rc, 0)
+	log.Printf("transparent: %s -> %s closed: %s", c.RemoteAddr(), addr, reason)
+}
+
+func isLocalIp(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// udpOriginalDst parses the IP_ORIGDSTADDR control message of a TPROXY datagram
+func udpOriginalDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(msg.Data) >= 8 {
+			return &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}, nil
+		}
+	}
+
+	return nil, errors.New("no original destination, is the packet coming from TPROXY?")
+}
+
+// transparentUdpSession a client talking to one destination, replies are sent from the original destination
+type transparentUdpSession struct {
+	// nil while dialing, the datagrams sent meanwhile wait in pending
+	remote  net.Conn
+	pending [][]byte
+
+	reply net.PacketConn
+}
+
+type transparentUdpServer struct {
+	h        *DefaultHandle
+	conn     *net.UDPConn
+	lock     sync.Mutex
+	sessions map[string]*transparentUdpSession
+}
+
+// dial connects a new session outside the lock, so a slow destination does not stall the other ones
+func (u *transparentUdpServer) dial(key string, session *transparentUdpSession, src, dst *net.UDPAddr, first []byte) {
+	remote, reply, err := u.h.dialTransparentUdp(src, dst)
+
+	u.lock.Lock()
+	if err != nil {
+		delete(u.sessions, key)
+		u.lock.Unlock()
+
+		log.Printf("transparent: udp %s -> %s failed: %s", src, dst, err.Error())
+		return
+	}
+
+	session.remote = remote
+	session.reply = reply
+	pending := session.pending
+	session.pending = nil
+	u.lock.Unlock()
+
+	for _, data := range append([][]byte{first}, pending...) {
+		_, _ = remote.Write(data)
+	}
+
+	defer func() {
+		u.lock.Lock()
+		delete(u.sessions, key)
+		u.lock.Unlock()
+
+		_ = remote.Close()
+		_ = reply.Close()
+	}()
+
+	buf := make([]byte, 65507)
+	for {
+		if err := remote.SetReadDeadline(time.Now().Add(transparentUdpTimeout)); err != nil {
+			return
+		}
+
+		n, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if _, err = reply.WriteTo(buf[:n], src); err != nil {
+			return
+		}
+	}
+}
+
+func (h *DefaultHandle) dialTransparentUdp(src, dst *net.UDPAddr) (net.Conn, net.PacketConn, error) {
+	remote, err := h.myDialer(withConnMeta(context.Background(), "transparent", src.String(), nil), "udp", nil, dst.String())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a non local bind to the original destination, so the client accepts the replies
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+				return
+			}
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}}
+	reply, err := lc.ListenPacket(context.Background(), "udp4", dst.String())
+	if err != nil {
+		_ = remote.Close()
+		return nil, nil, err
+	}
+
+	return remote, reply, nil
+}
+
+func (u *transparentUdpServer) forward(src, dst *net.UDPAddr, data []byte) {
+	key := src.String() + "->" + dst.String()
+
+	u.lock.Lock()
+	session, ok := u.sessions[key]
+	if !ok {
+		session = &transparentUdpSession{}
+		u.sessions[key] = session
+		u.lock.Unlock()
+
+		go u.dial(key, session, src, dst, append([]byte(nil), data...))
+		return
+	}
+
+	if session.remote == nil {
+		if len(session.pending) < udpMaxPending {
+			session.pending = append(session.pending, append([]byte(nil), data...))
+		}
+		u.lock.Unlock()
+		return
+	}
+
+	remote := session.remote
+	u.lock.Unlock()
+
+	// a broken destination is noticed by its reader
+	_, _ = remote.Write(data)
+}
+
+func (u *transparentUdpServer) serve() {
+	buf := make([]byte, 65507)
+	oob := make([]byte, 1024)
+
+	for {
+		n, oobn, _, src, err := u.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			log.Printf("Transparent udp server stopped: %s", err.Error())
+			return
+		}
+
+		if !u.h.acl.Check("transparent", src) {
+			continue
+		}
+
+		dst, err := udpOriginalDst(oob[:oobn])
+		if err != nil {
+			log.Printf("transparent: udp from %s: %s", src, err.Error())
+			continue
+		}
+
+		u.forward(src, dst, buf[:n])
+	}
+}
+
+// ServeTransparent accepts tcp connections redirected by iptables REDIRECT or TPROXY,
+// and udp packets redirected by TPROXY, on the same port. They are routed like the socks5 ones.
+// TPROXY and udp need CAP_NET_ADMIN. Traffic of this process must not be redirected again, e.g. only redirect in PREROUTING.
+func ServeTransparent(h *DefaultHandle, bindAddr string) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if err := setTransparent(network, address, c); err != nil {
+			if network == "udp" || network == "udp4" {
+				return err
+			}
+			// REDIRECT works without it
+			log.Printf("transparent: IP_TRANSPARENT not available, only REDIRECT is supported for tcp: %s", err.Error())
+		}
+		return nil
+	}}
+
+	udpConn, err := lc.ListenPacket(context.Background(), "udp4", bindAddr)
+	if err != nil {
+		log.Printf("Transparent udp server disabled: %s", err.Error())
+	} else {
+		u := &transparentUdpServer{h: h, conn: udpConn.(*net.UDPConn), sessions: map[string]*transparentUdpSession{}}
+		go u.serve()
+	}
+
+	listener, err := lc.Listen(context.Background(), "tcp4", bindAddr)
+	if err != nil {
+		log.Printf("Transparent proxy stopped: %s", err.Error())
+		return
+	}
+	defer listener.Close()
+
+	listenAddr := listener.Addr().(*net.TCPAddr)
+	log.Printf("Transparent proxy listening on %s", listenAddr)
+
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			log.Printf("Transparent proxy stopped: %s", err.Error())
+			return
+		}
+
+		if !h.acl.Check("transparent", c.RemoteAddr()) {
+			_ = c.Close()
+			continue
+		}
+
+		go serveTransparentTcpConn(h, c.(*net.TCPConn), listenAddr)
+	}
+}
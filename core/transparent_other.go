@@ -0,0 +1,10 @@
+//go:build !linux
+
+package core
+
+import "log"
+
+// ServeTransparent needs SO_ORIGINAL_DST / TPROXY, which only exist on linux
+func ServeTransparent(h *DefaultHandle, bindAddr string) {
+	log.Printf("Transparent proxy is only supported on linux")
+}
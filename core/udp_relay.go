@@ -0,0 +1,501 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	txSocks5 "github.com/txthinking/socks5"
+)
+
+const (
+	// the largest udp payload
+	udpBufSize = 65507
+	// the largest socks5 udp header: rsv, frag, atyp, domain length + domain, port
+	udpMaxHeader = 4 + 1 + 255 + 2
+
+	// fragments of a datagram must all arrive within this time (RFC 1928 section 7)
+	udpFragTimeout = 5 * time.Second
+
+	// datagrams kept for a destination while it is being dialed
+	udpMaxPending = 8
+)
+
+var udpBufPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, udpMaxHeader+udpBufSize)
+	return &b
+}}
+
+// udpReplyHeader the socks5 udp header of the datagrams coming back from dst, the address the client asked for
+func udpReplyHeader(dst string) ([]byte, error) {
+	atyp, addr, port, err := txSocks5.ParseAddress(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{0x00, 0x00, 0x00, atyp}, addr...)
+	return append(header, port...), nil
+}
+
+// udpRemote a destination of an association, dialed through myDialer like a tcp connection
+type udpRemote struct {
+	assoc  *udpAssociation
+	dst    string
+	header []byte
+
+	// nil while dialing, the datagrams sent meanwhile wait in pending
+	conn    net.Conn
+	pending [][]byte
+
+	lastActivity int64
+}
+
+type udpFragment struct {
+	pos  byte
+	data []byte
+}
+
+// udpAssociation the relay of one client udp address, like a NAT entry.
+// It lives as long as the tcp connection of its UDP ASSOCIATE, or until its last destination went idle without one.
+type udpAssociation struct {
+	relay *udpRelay
+
+	// expected source of the client, port 0 until its first datagram when the client did not tell
+	ip     net.IP
+	port   int
+	client *net.UDPAddr
+
+	controlled bool
+	closed     bool
+
+	remotes map[string]*udpRemote
+
+	frags     []udpFragment
+	fragDst   string
+	fragStart time.Time
+}
+
+// udpRelay the socks5 udp server, all its state is guarded by lock
+type udpRelay struct {
+	h    *DefaultHandle
+	conn *net.UDPConn
+
+	// only clients that sent a UDP ASSOCIATE over tcp may relay
+	requireAssoc bool
+	idleTimeout  time.Duration
+	maxRemotes   int
+
+	lock    sync.Mutex
+	assocs  map[string]*udpAssociation // client address -> association
+	unbound []*udpAssociation          // associated over tcp, waiting for the first datagram
+}
+
+func newUdpRelay(h *DefaultHandle, conn *net.UDPConn, requireAssoc bool, idleTimeout time.Duration, maxRemotes int) *udpRelay {
+	return &udpRelay{
+		h:            h,
+		conn:         conn,
+		requireAssoc: requireAssoc,
+		idleTimeout:  idleTimeout,
+		maxRemotes:   maxRemotes,
+		assocs:       map[string]*udpAssociation{},
+	}
+}
+
+func (u *udpRelay) newAssociation(ip net.IP, port int, controlled bool) *udpAssociation {
+	return &udpAssociation{relay: u, ip: ip, port: port, controlled: controlled, remotes: map[string]*udpRemote{}}
+}
+
+// bind makes a the association of client, must be called with the lock held
+func (u *udpRelay) bind(a *udpAssociation, client *net.UDPAddr) {
+	if old, ok := u.assocs[client.String()]; ok && old != a {
+		// the client reused its address for a new association
+		go old.close("replaced")
+	}
+
+	a.client = client
+	a.port = client.Port
+	u.assocs[client.String()] = a
+}
+
+// associate registers the UDP ASSOCIATE of a tcp connection, the client sends from ip:port (port 0 if unknown)
+func (u *udpRelay) associate(ip net.IP, port int) *udpAssociation {
+	a := u.newAssociation(ip, port, true)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if port != 0 {
+		u.bind(a, &net.UDPAddr{IP: ip, Port: port})
+	} else {
+		u.unbound = append(u.unbound, a)
+	}
+
+	return a
+}
+
+// lookup finds the association of a datagram from src, nil if there is none. Must be called with the lock held.
+func (u *udpRelay) lookup(src *net.UDPAddr) *udpAssociation {
+	if a, ok := u.assocs[src.String()]; ok {
+		return a
+	}
+
+	for i, a := range u.unbound {
+		if a.ip.Equal(src.IP) {
+			u.unbound = append(u.unbound[:i], u.unbound[i+1:]...)
+			u.bind(a, src)
+			return a
+		}
+	}
+
+	if u.requireAssoc {
+		return nil
+	}
+
+	a := u.newAssociation(src.IP, src.Port, false)
+	u.bind(a, src)
+	return a
+}
+
+// serveAssociate answers a UDP ASSOCIATE and keeps the association until the tcp connection closes
+func (u *udpRelay) serveAssociate(c *net.TCPConn, r *txSocks5.Request) error {
+	ip := c.RemoteAddr().(*net.TCPAddr).IP
+	if r.Atyp == txSocks5.ATYPIPv4 || r.Atyp == txSocks5.ATYPIPv6 {
+		if requested := net.IP(r.DstAddr); !requested.IsUnspecified() {
+			ip = requested
+		}
+	}
+	port := int(binary.BigEndian.Uint16(r.DstPort))
+
+	// the udp server as reached by the client, its tcp listener may be on another address
+	udpAddr := u.conn.LocalAddr().(*net.UDPAddr)
+	relayAddr := &net.TCPAddr{IP: c.LocalAddr().(*net.TCPAddr).IP, Port: udpAddr.Port}
+	if !udpAddr.IP.IsUnspecified() {
+		relayAddr.IP = udpAddr.IP
+	}
+
+	if err := writeSocks5Reply(c, txSocks5.RepSuccess, relayAddr); err != nil {
+		return err
+	}
+
+	a := u.associate(ip, port)
+	defer a.close("tcp closed")
+
+	// deadlines of the negotiation
+	_ = c.SetDeadline(time.Time{})
+
+	_, _ = io.Copy(io.Discard, c)
+
+	if txSocks5.Debug {
+		log.Printf("socks5: udp association of %s closed", c.RemoteAddr())
+	}
+
+	return nil
+}
+
+// serve reads the datagrams of the clients until the udp socket is closed
+func (u *udpRelay) serve() {
+	for {
+		buf := udpBufPool.Get().(*[]byte)
+
+		n, src, err := u.conn.ReadFromUDP((*buf)[:udpBufSize])
+		if err != nil {
+			udpBufPool.Put(buf)
+			log.Printf("Socks5 udp server stopped: %s", err.Error())
+			return
+		}
+
+		u.handle(src, (*buf)[:n])
+		udpBufPool.Put(buf)
+	}
+}
+
+// handle relays a datagram of a client, b is reused once it returns
+func (u *udpRelay) handle(src *net.UDPAddr, b []byte) {
+	if !u.h.acl.Check("socks5", src) {
+		return
+	}
+
+	d, err := txSocks5.NewDatagramFromBytes(b)
+	if err != nil {
+		log.Printf("socks5: bad udp datagram from %s: %s", src, err.Error())
+		return
+	}
+
+	u.lock.Lock()
+
+	a := u.lookup(src)
+	if a == nil {
+		u.lock.Unlock()
+		if txSocks5.Debug {
+			log.Printf("socks5: udp from %s is not associated with tcp", src)
+		}
+		return
+	}
+
+	data, dst := d.Data, d.Address()
+	if d.Frag != 0 {
+		var ok bool
+		if data, dst, ok = a.reassemble(d); !ok {
+			u.lock.Unlock()
+			return
+		}
+	} else {
+		// a datagram without fragments abandons the ones being reassembled
+		a.frags = nil
+	}
+
+	r, ok := a.remotes[dst]
+	if !ok {
+		_, err = a.addRemote(dst, append([]byte(nil), data...))
+		u.lock.Unlock()
+		if err != nil {
+			log.Printf("socks5: udp %s -> %s: %s", src, dst, err.Error())
+		}
+		return
+	}
+
+	atomic.StoreInt64(&r.lastActivity, time.Now().UnixNano())
+
+	if r.conn == nil {
+		if len(r.pending) < udpMaxPending {
+			r.pending = append(r.pending, append([]byte(nil), data...))
+		}
+		u.lock.Unlock()
+		return
+	}
+
+	conn := r.conn
+	u.lock.Unlock()
+
+	// a broken destination is noticed by its reader
+	_, _ = conn.Write(data)
+}
+
+// reassemble queues a fragment, the whole datagram is returned with the last one (RFC 1928 section 7).
+// Must be called with the lock held.
+func (a *udpAssociation) reassemble(d *txSocks5.Datagram) ([]byte, string, bool) {
+	pos := d.Frag & 0x7f
+	now := time.Now()
+
+	// a lower position starts a new datagram, so does a fragment arriving too late
+	if len(a.frags) > 0 && (pos <= a.frags[len(a.frags)-1].pos || now.Sub(a.fragStart) > udpFragTimeout) {
+		a.frags = nil
+	}
+
+	if len(a.frags) == 0 {
+		a.fragStart = now
+		a.fragDst = d.Address()
+	}
+
+	size := len(d.Data)
+	for _, f := range a.frags {
+		size += len(f.data)
+	}
+	if size > udpBufSize {
+		a.frags = nil
+		return nil, "", false
+	}
+
+	a.frags = append(a.frags, udpFragment{pos: pos, data: append([]byte(nil), d.Data...)})
+
+	// the high bit marks the last fragment
+	if d.Frag&0x80 == 0 {
+		return nil, "", false
+	}
+
+	data := make([]byte, 0, size)
+	for _, f := range a.frags {
+		data = append(data, f.data...)
+	}
+	a.frags = nil
+
+	return data, a.fragDst, true
+}
+
+// addRemote starts dialing dst, first is sent once connected. Must be called with the lock held.
+func (a *udpAssociation) addRemote(dst string, first []byte) (*udpRemote, error) {
+	header, err := udpReplyHeader(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	u := a.relay
+	if u.maxRemotes > 0 && len(a.remotes) >= u.maxRemotes {
+		a.evictOldest()
+	}
+
+	r := &udpRemote{assoc: a, dst: dst, header: header, lastActivity: time.Now().UnixNano()}
+	a.remotes[dst] = r
+
+	go r.dial(first)
+
+	return r, nil
+}
+
+// evictOldest drops the destination idle for the longest time. Must be called with the lock held.
+func (a *udpAssociation) evictOldest() {
+	var oldest *udpRemote
+	for _, r := range a.remotes {
+		if oldest == nil || atomic.LoadInt64(&r.lastActivity) < atomic.LoadInt64(&oldest.lastActivity) {
+			oldest = r
+		}
+	}
+
+	if oldest == nil {
+		return
+	}
+
+	delete(a.remotes, oldest.dst)
+	if oldest.conn != nil {
+		go closeUdpRemote(oldest.conn, "evicted, too many destinations")
+	}
+}
+
+// closeIfUnused ends an association not controlled by tcp once it has no destination left.
+// Must be called with the lock held.
+func (a *udpAssociation) closeIfUnused() {
+	if a.controlled || a.closed || len(a.remotes) > 0 {
+		return
+	}
+
+	a.closed = true
+	if a.client != nil && a.relay.assocs[a.client.String()] == a {
+		delete(a.relay.assocs, a.client.String())
+	}
+}
+
+// close ends the association and all its destinations
+func (a *udpAssociation) close(reason string) {
+	u := a.relay
+
+	u.lock.Lock()
+	if a.closed {
+		u.lock.Unlock()
+		return
+	}
+	a.closed = true
+
+	if a.client != nil && u.assocs[a.client.String()] == a {
+		delete(u.assocs, a.client.String())
+	}
+	for i, unbound := range u.unbound {
+		if unbound == a {
+			u.unbound = append(u.unbound[:i], u.unbound[i+1:]...)
+			break
+		}
+	}
+
+	var conns []net.Conn
+	for _, r := range a.remotes {
+		if r.conn != nil {
+			conns = append(conns, r.conn)
+		}
+	}
+	a.remotes = map[string]*udpRemote{}
+	u.lock.Unlock()
+
+	for _, conn := range conns {
+		closeUdpRemote(conn, reason)
+	}
+}
+
+func closeUdpRemote(conn net.Conn, reason string) {
+	if tracked, ok := conn.(*trackedConn); ok {
+		tracked.setCloseReason(reason)
+	}
+	_ = conn.Close()
+}
+
+func (r *udpRemote) dial(first []byte) {
+	u := r.assoc.relay
+
+	ctx := withConnMeta(context.Background(), "socks5", r.assoc.client.String(), nil)
+	conn, err := u.h.myDialer(ctx, "udp", nil, r.dst)
+
+	u.lock.Lock()
+	if r.assoc.remotes[r.dst] != r {
+		// evicted or the association closed while dialing
+		u.lock.Unlock()
+		if conn != nil {
+			closeUdpRemote(conn, "association closed")
+		}
+		return
+	}
+
+	if err != nil {
+		delete(r.assoc.remotes, r.dst)
+		r.assoc.closeIfUnused()
+		u.lock.Unlock()
+
+		log.Printf("socks5: udp %s -> %s failed: %s", r.assoc.client, r.dst, err.Error())
+		return
+	}
+
+	r.conn = conn
+	pending := r.pending
+	r.pending = nil
+	u.lock.Unlock()
+
+	for _, data := range append([][]byte{first}, pending...) {
+		_, _ = conn.Write(data)
+	}
+
+	r.read()
+}
+
+// read sends the datagrams of the destination back to the client until it is idle for idleTimeout
+func (r *udpRemote) read() {
+	u := r.assoc.relay
+
+	buf := udpBufPool.Get().(*[]byte)
+	defer udpBufPool.Put(buf)
+
+	b := *buf
+	headerLen := copy(b, r.header)
+
+	reason := "closed"
+	defer func() {
+		u.lock.Lock()
+		if r.assoc.remotes[r.dst] == r {
+			delete(r.assoc.remotes, r.dst)
+			r.assoc.closeIfUnused()
+		}
+		u.lock.Unlock()
+
+		closeUdpRemote(r.conn, reason)
+	}()
+
+	for {
+		if u.idleTimeout > 0 {
+			if err := r.conn.SetReadDeadline(time.Now().Add(u.idleTimeout)); err != nil {
+				return
+			}
+		}
+
+		n, err := r.conn.Read(b[headerLen : headerLen+udpBufSize])
+		if err != nil {
+			if isTimeout(err) {
+				// the client may still be sending
+				if time.Since(time.Unix(0, atomic.LoadInt64(&r.lastActivity))) < u.idleTimeout {
+					continue
+				}
+				reason = errIdleTimeout.Error()
+				return
+			}
+			reason = "remote error: " + err.Error()
+			return
+		}
+
+		atomic.StoreInt64(&r.lastActivity, time.Now().UnixNano())
+
+		if _, err = u.conn.WriteToUDP(b[:headerLen+n], r.assoc.client); err != nil {
+			reason = "client error: " + err.Error()
+			return
+		}
+	}
+}
@@ -7,6 +7,9 @@ require github.com/refraction-networking/utls v1.2.1
 require (
 	github.com/cornelk/hashmap v1.0.8
 	github.com/dlclark/regexp2 v1.8.0
+	github.com/txthinking/socks5 v0.0.0-20230204071052-424978e4d479
+	golang.org/x/crypto v0.5.0
+	golang.org/x/net v0.5.0
 	gvisor.dev/gvisor v0.0.0-20230128000341-b7014294633b
 	tailscale.com v1.36.0
 )
@@ -17,10 +20,8 @@ require (
 	github.com/klauspost/compress v1.15.15 // indirect
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
 	github.com/txthinking/runnergroup v0.0.0-20210608031112-152c7c4432bf // indirect
-	github.com/txthinking/socks5 v0.0.0-20230204071052-424978e4d479 // indirect
 	github.com/txthinking/x v0.0.0-20210326105829-476fab902fbe // indirect
 	go4.org/mem v0.0.0-20210711025021-927187094b94 // indirect
-	golang.org/x/crypto v0.5.0 // indirect
 	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
 	golang.org/x/sys v0.4.0 // indirect
 	golang.org/x/time v0.0.0-20220609170525-579cf78fd858 // indirect
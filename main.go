@@ -4,16 +4,51 @@ import (
 	"EasierConnect/core"
 	"flag"
 	"log"
+	"os"
 )
 
 func main() {
 	// CLI args
 	host, port, username, password, twfId := "", 0, "", "", ""
+	exportFormat, exportDir := "", ""
 	flag.StringVar(&host, "server", "", "EasyConnect server address (e.g. vpn.nju.edu.cn, sslvpn.sysu.edu.cn)")
 	flag.StringVar(&username, "username", "", "Your username")
 	flag.StringVar(&password, "password", "", "Your password")
-	flag.StringVar(&core.SocksBind, "socks-bind", ":1080", "The addr socks5 server listens on (e.g. 0.0.0.0:1080)")
+	flag.StringVar(&core.SocksBind, "socks-bind", ":1080", "The addrs socks5 server listens on, comma separated, unix:/path for a unix socket (e.g. 0.0.0.0:1080,unix:/tmp/easier.sock)")
+	flag.StringVar(&core.SocksUser, "socks-user", os.Getenv("EASIER_SOCKS_USER"), "Username required by the socks5 server and the http proxy (env: EASIER_SOCKS_USER)")
+	flag.StringVar(&core.SocksPassword, "socks-password", os.Getenv("EASIER_SOCKS_PASSWORD"), "Password required by the socks5 server (env: EASIER_SOCKS_PASSWORD)")
+	flag.StringVar(&core.SocksAuthFile, "socks-auth-file", os.Getenv("EASIER_SOCKS_AUTH_FILE"), "htpasswd-style file of socks5 users, plain/bcrypt/{SHA} passwords (env: EASIER_SOCKS_AUTH_FILE)")
+	flag.StringVar(&core.ClientAllow, "allow-clients", "", "Comma separated CIDRs of the clients allowed on every listener, empty to allow all (e.g. 127.0.0.1,172.17.0.0/16)")
+	flag.StringVar(&core.ClientDeny, "deny-clients", "", "Comma separated CIDRs of the clients denied on every listener, checked before -allow-clients")
+	flag.StringVar(&core.HttpBind, "http-bind", "", "The addrs http proxy server listens on, comma separated, unix:/path for a unix socket, empty to disable (e.g. 127.0.0.1:8080)")
+	flag.StringVar(&core.PacBind, "pac-bind", "", "The addr proxy.pac server listens on, empty to disable (e.g. 127.0.0.1:8081)")
+	flag.StringVar(&core.TransparentBind, "transparent-bind", "", "The addr transparent proxy listens on for iptables REDIRECT/TPROXY traffic (linux only, tcp and udp), empty to disable, must be loopback or restricted by -allow-clients when socks auth is set (e.g. 0.0.0.0:12345)")
+	flag.StringVar(&core.DnsBind, "dns-bind", "", "The addr local dns server listens on (udp and tcp), empty to disable, must be loopback or restricted by -allow-clients when socks auth is set (e.g. 127.0.0.1:5353)")
+	flag.StringVar(&core.DnsUpstream, "dns-upstream", core.DnsUpstream, "Public dns server for non intranet names, empty to use the system resolver for socks connections")
+	flag.BoolVar(&core.DnsLeakProtection, "dns-leak-protection", core.DnsLeakProtection, "Never send intranet names to the public dns, they fail if the tunnel dns is unreachable, and the pac does not resolve names")
+	flag.StringVar(&core.IntranetSuffixes, "intranet-suffixes", "", "Comma separated domain suffixes treated as intranet names besides the server rules (e.g. corp.example.com,intra)")
+	flag.StringVar(&core.DnsResolvers, "dns-resolvers", "", "Comma separated dns upstreams replacing tunnel dns + -dns-upstream: tunnel-udp://[ip], tunnel-tcp://[ip], udp://ip:port, tls://host:853, https://host/dns-query, each may end with ?timeout=2s")
+	flag.StringVar(&core.DnsStrategy, "dns-strategy", core.DnsStrategy, "How the dns upstreams are queried: fallback (in order) or race (all at once, first answer wins)")
+	flag.IntVar(&core.DnsCacheSize, "dns-cache-size", core.DnsCacheSize, "Max domains kept in the dns cache of the socks resolver, 0 to disable")
+	flag.IntVar(&core.MaxConns, "max-conns", 0, "Max concurrent proxied connections of all clients, 0 to use the server maxsession, -1 for no limit")
+	flag.IntVar(&core.MaxConnsPerClient, "max-conns-per-client", 0, "Max concurrent proxied connections of one client ip, 0 to use the server maxthread, -1 for no limit")
+	flag.Float64Var(&core.ConnRate, "conn-rate", 0, "Max new proxied connections per second of all clients, 0 for no limit")
+	flag.Float64Var(&core.ConnRatePerClient, "conn-rate-per-client", 0, "Max new proxied connections per second of one client ip, 0 for no limit")
+	flag.IntVar(&core.DialTimeout, "dial-timeout", core.DialTimeout, "Seconds resolving and connecting a target may take, through the tunnel or directly, 0 for no limit")
+	flag.BoolVar(&core.SmartRouting, "smart-routing", false, "Try the other route (vpn or direct) when the one chosen by the rules fails, and remember the ones that worked")
+	flag.IntVar(&core.SmartFallbackTimeout, "smart-fallback-timeout", core.SmartFallbackTimeout, "Seconds the route chosen by the rules is given before falling back, 0 to wait for it to fail")
+	flag.StringVar(&core.LearnedRulesFile, "learned-rules", "", "JSON file the smart routing keeps its learned routes in, empty to keep them in memory only")
+	flag.DurationVar(&core.LearnedRulesTTL, "learned-rules-ttl", core.LearnedRulesTTL, "How long a learned route is used before the rules are trusted again")
+	flag.IntVar(&core.UdpTimeout, "udp-timeout", core.UdpTimeout, "Seconds a socks5 udp destination is kept without traffic, 0 to keep it until the association ends")
+	flag.IntVar(&core.UdpMaxDestinations, "udp-max-destinations", core.UdpMaxDestinations, "Max destinations of one socks5 udp association, the least recently used one is dropped beyond, 0 for no limit")
+	flag.StringVar(&core.LocalRulesFile, "local-rules", "", "File of user defined routing rules (type,value,vpn|direct|reject[,ports] per line), reloaded on change")
+	flag.StringVar(&core.LocalRulesPolicy, "local-rules-policy", core.LocalRulesPolicy, "Evaluate local rules before or after the server rules (before, after)")
+	flag.StringVar(&core.AccessLogFile, "access-log", "", "JSON Lines access log of the proxied connections: a file, - for stdout, syslog or syslog://host:514, empty to disable")
+	flag.Int64Var(&core.AccessLogMaxSize, "access-log-max-size", core.AccessLogMaxSize, "Rotate the access log file once it is larger than this many bytes, 0 to never rotate")
+	flag.IntVar(&core.AccessLogBackups, "access-log-backups", core.AccessLogBackups, "Number of rotated access log files kept")
 	flag.StringVar(&twfId, "twf-id", "", "Login using twfID captured (mostly for debug usage)")
+	flag.StringVar(&exportFormat, "export-rules", "", "Export the server rules and exit, format: clash, sing-box, surge or all")
+	flag.StringVar(&exportDir, "export-dir", ".", "Directory the exported rule files are written to")
 	flag.IntVar(&port, "port", 443, "EasyConnect port address (e.g. 443)")
 	core.DebugDump = false
 	core.ParseServConfig = true
@@ -21,6 +56,14 @@ func main() {
 	flag.BoolVar(&core.ParseServConfig, "parse", true, "parse server buildconfig")
 	flag.Parse()
 
+	if exportFormat != "" {
+		if host == "" || ((username == "" || password == "") && twfId == "") {
+			log.Fatal("Exporting rules requires -server and the login credentials.")
+		}
+		core.ExportClientRules(host, port, username, password, twfId, exportFormat, exportDir)
+		return
+	}
+
 	if host == "" || ((username == "" || password == "") && twfId == "") {
 		log.Printf("Starting as ECAgent mode. For more infomations: `EasierConnect --help`.\n")
 		core.StartECAgent()